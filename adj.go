@@ -200,39 +200,3 @@ func applyFunc(db fdb.Transactor, stmt *selectStmt, recs []([2]tuple.Tuple)) {
 		}
 	}
 }
-
-func applyFuncOne(db fdb.Transactor, stmt *selectStmt, value tuple.Tuple) {
-	adjs := stmt.Adjs
-	if adjs != nil {
-		sec, _ := getInt(stmt.Conds[0].Equal)
-		tm, _ := getInt(stmt.Conds[len(stmt.Conds)-1].Equal.(tuple.Tuple)[0])
-		applyAdjOne(db, stmt, int(sec), tm, value)
-	}
-}
-
-func applyAdjOne(db fdb.Transactor, stmt *selectStmt, sec int, tm int64, value tuple.Tuple) {
-	adjs := adjCache.get(db, stmt.Schema.DbName, sec)
-	if len(adjs) == 0 {
-		return
-	}
-	i := adjs.bisectRight(tm)
-	b := stmt.Adjs[0].Backward
-	if b {
-		if i == 0 {
-			return
-		}
-		i -= 1
-	} else {
-		if i == len(adjs) {
-			return
-		}
-	}
-	adj := adjs[i]
-	for _, col := range stmt.Adjs {
-		if col.Pos < len(value) {
-			if v, ok := getFloat(value[col.Pos]); ok {
-				value[col.Pos] = v * adj.get(b, col.Adj)
-			}
-		}
-	}
-}
@@ -0,0 +1,421 @@
+package opentick
+
+import (
+	"bytes"
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type aggFunc struct {
+	Name   string
+	Weight *TableColDef // of vwap
+}
+
+type timeBucket struct {
+	Col      *TableColDef
+	Interval int64           // nanoseconds
+	Session  *tradingSession // buckets aligned to session start if set
+}
+
+type aggState struct {
+	count   int64
+	sumI    int64
+	sumF    float64
+	isFloat bool
+	value   interface{}
+	has     bool
+	sumW    float64 // of vwap
+}
+
+func (self *aggState) add(name string, v interface{}, reverse bool) {
+	if v == nil {
+		return
+	}
+	switch name {
+	case "sum", "avg":
+		if v1, ok := getInt(v); ok {
+			self.sumI += v1
+			self.sumF += float64(v1)
+		} else if v1, ok := getFloat(v); ok {
+			self.sumF += v1
+			self.isFloat = true
+		} else {
+			return
+		}
+	case "min":
+		if !self.has || compareValue(v, self.value) < 0 {
+			self.value = v
+		}
+	case "max":
+		if !self.has || compareValue(v, self.value) > 0 {
+			self.value = v
+		}
+	case "first":
+		// rows come in descending key order if reversed
+		if !self.has || reverse {
+			self.value = v
+		}
+	case "last":
+		if !self.has || !reverse {
+			self.value = v
+		}
+	}
+	self.count++
+	self.has = true
+}
+
+func (self *aggState) addWeighted(v interface{}, w interface{}) {
+	v1, ok1 := getFloat(v)
+	w1, ok2 := getFloat(w)
+	if !ok1 || !ok2 {
+		return
+	}
+	self.sumF += v1 * w1
+	self.sumW += w1
+	self.count++
+	self.has = true
+}
+
+func (self *aggState) result(name string) interface{} {
+	switch name {
+	case "vwap":
+		if self.sumW == 0 {
+			return nil
+		}
+		return self.sumF / self.sumW
+	case "count":
+		return self.count
+	case "sum":
+		if !self.has {
+			return nil
+		}
+		if self.isFloat {
+			return self.sumF
+		}
+		return self.sumI
+	case "avg":
+		if self.count == 0 {
+			return nil
+		}
+		return self.sumF / float64(self.count)
+	}
+	return self.value
+}
+
+type aggGroup struct {
+	row    []interface{}
+	states []aggState
+	keys   tuple.Tuple // values of GROUP BY
+	bucket int64
+}
+
+func newAggGroup(stmt *selectStmt, keys tuple.Tuple, bucket interface{}, rec [2]tuple.Tuple) *aggGroup {
+	g := &aggGroup{make([]interface{}, len(stmt.Cols)), make([]aggState, len(stmt.Cols)), keys, 0}
+	g.bucket, _ = getTimestamp(bucket)
+	for j, col := range stmt.Cols {
+		if stmt.Aggs[j] != nil {
+			continue
+		}
+		if stmt.Bucket != nil && col == stmt.Bucket.Col {
+			g.row[j] = bucket
+		} else {
+			g.row[j] = getColValue(col, rec)
+		}
+	}
+	return g
+}
+
+func (self *aggGroup) add(stmt *selectStmt, rec [2]tuple.Tuple) {
+	for j, a := range stmt.Aggs {
+		if a == nil {
+			continue
+		}
+		if stmt.Cols[j] == nil {
+			self.states[j].count++
+			continue
+		}
+		if a.Weight != nil {
+			self.states[j].addWeighted(getColValue(stmt.Cols[j], rec), getColValue(a.Weight, rec))
+			continue
+		}
+		self.states[j].add(a.Name, getColValue(stmt.Cols[j], rec), stmt.Reverse)
+	}
+}
+
+func (self *aggGroup) result(stmt *selectStmt) {
+	for j, a := range stmt.Aggs {
+		if a != nil {
+			self.row[j] = self.states[j].result(a.Name)
+		}
+	}
+}
+
+// groups accumulated page by page, in the order records are read
+type aggregator struct {
+	stmt   *selectStmt
+	groups []*aggGroup
+	index  map[string]*aggGroup
+}
+
+func newAggregator(stmt *selectStmt) *aggregator {
+	return &aggregator{stmt: stmt, index: make(map[string]*aggGroup)}
+}
+
+func (self *aggregator) add(recs [][2]tuple.Tuple) {
+	stmt := self.stmt
+	for _, rec := range recs {
+		keys := make(tuple.Tuple, len(stmt.GroupBy), len(stmt.GroupBy)+1)
+		for i, col := range stmt.GroupBy {
+			keys[i] = getColValue(col, rec)
+		}
+		var bucket interface{}
+		if stmt.Bucket != nil {
+			bucket = stmt.Bucket.get(getColValue(stmt.Bucket.Col, rec))
+			if bucket == nil {
+				// out of session
+				continue
+			}
+		}
+		k := string(append(keys, bucket).Pack())
+		g, ok := self.index[k]
+		if !ok {
+			g = newAggGroup(stmt, keys, bucket, rec)
+			self.index[k] = g
+			self.groups = append(self.groups, g)
+		}
+		g.add(stmt, rec)
+	}
+}
+
+// fill is nil if no FILL
+func (self *aggregator) result(fill *fillGrid) (res [][]interface{}) {
+	stmt := self.stmt
+	groups := self.groups
+	if len(groups) == 0 && stmt.GroupBy == nil && stmt.Bucket == nil {
+		groups = append(groups, &aggGroup{row: make([]interface{}, len(stmt.Cols)), states: make([]aggState, len(stmt.Cols))})
+	}
+	for _, g := range groups {
+		g.result(stmt)
+	}
+	if fill != nil {
+		groups = fill.apply(stmt, groups)
+	}
+	if stmt.Offset > 0 {
+		if stmt.Offset >= len(groups) {
+			return
+		}
+		groups = groups[stmt.Offset:]
+	}
+	if stmt.Limit > 0 && len(groups) > stmt.Limit {
+		groups = groups[:stmt.Limit]
+	}
+	res = make([][]interface{}, len(groups))
+	for i, g := range groups {
+		res[i] = g.row
+	}
+	return
+}
+
+// fill is nil if no FILL
+func aggregate(stmt *selectStmt, recs [][2]tuple.Tuple, fill *fillGrid) (res [][]interface{}) {
+	a := newAggregator(stmt)
+	a.add(recs)
+	return a.result(fill)
+}
+
+func resolveGroupBy(stmt *selectStmt, groupBy []AstGroupBy) (err error) {
+	schema := stmt.Schema
+	for _, g := range groupBy {
+		if g.Bucket != nil {
+			if stmt.Bucket != nil {
+				return errors.New("Only one bucket allowed in GROUP BY")
+			}
+			col, ok := schema.NameMap[*g.Bucket.Col]
+			if !ok {
+				return errors.New("Undefined column name " + *g.Bucket.Col)
+			}
+			if col.Type != Timestamp {
+				return errors.New("Invalid column " + col.Name + " of " + col.Type.Name() + " for bucket, timestamp expected")
+			}
+			interval, err1 := parseInterval(*g.Bucket.Interval)
+			if err1 != nil {
+				return err1
+			}
+			stmt.Bucket = &timeBucket{Col: col, Interval: interval}
+			continue
+		}
+		col, ok := schema.NameMap[*g.Name]
+		if !ok {
+			return errors.New("Undefined column name " + *g.Name)
+		}
+		for _, col2 := range stmt.GroupBy {
+			if col2 == col {
+				return errors.New("Duplicate column name " + col.Name + " in GROUP BY")
+			}
+		}
+		stmt.GroupBy = append(stmt.GroupBy, col)
+	}
+	for j, col := range stmt.Cols {
+		if a := stmt.Aggs[j]; a != nil {
+			// symbol ids are not ordered by name
+			if col != nil && col.Type == Symbol && a.Name != "count" && a.Name != "first" && a.Name != "last" {
+				return errors.New("Invalid aggregate " + a.Name + " on \"" + col.Name + "\" of type Symbol")
+			}
+			continue
+		}
+		found := stmt.Bucket != nil && stmt.Bucket.Col == col
+		for _, col2 := range stmt.GroupBy {
+			if col2 == col {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("Column " + col.Name + " must appear in the GROUP BY clause or be used in an aggregate function")
+		}
+	}
+	return
+}
+
+func (self *timeBucket) get(v interface{}) interface{} {
+	ns, ok := getTimestamp(v)
+	if !ok {
+		return nil
+	}
+	ns, ok = self.floor(ns)
+	if !ok {
+		return nil
+	}
+	return nsToTimestamp(ns)
+}
+
+// start of the bucket ns falls in, false if out of session
+func (self *timeBucket) floor(ns int64) (ret int64, ok bool) {
+	if self.Session != nil {
+		start, ok1 := self.Session.start(ns)
+		if !ok1 {
+			return
+		}
+		return start + floorDiv(ns-start, self.Interval)*self.Interval, true
+	}
+	return floorDiv(ns, self.Interval) * self.Interval, true
+}
+
+func floorDiv(a int64, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// nanoseconds since epoch of a timestamp tuple
+func getTimestamp(v interface{}) (ret int64, ok bool) {
+	tm, ok1 := v.(tuple.Tuple)
+	if !ok1 || len(tm) != 2 {
+		return
+	}
+	sec, ok2 := getInt(tm[0])
+	nsec, ok3 := getInt(tm[1])
+	if !ok2 || !ok3 {
+		return
+	}
+	return sec*1e9 + nsec, true
+}
+
+var intervalUnits = map[string]time.Duration{
+	"ns":     time.Nanosecond,
+	"us":     time.Microsecond,
+	"ms":     time.Millisecond,
+	"s":      time.Second,
+	"sec":    time.Second,
+	"second": time.Second,
+	"m":      time.Minute,
+	"min":    time.Minute,
+	"minute": time.Minute,
+	"h":      time.Hour,
+	"hour":   time.Hour,
+	"d":      24 * time.Hour,
+	"day":    24 * time.Hour,
+	"w":      7 * 24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+var intervalRegexp = regexp.MustCompile(`^(\d+)\s*([a-zA-Z]+)$`)
+
+// parse interval like '5m', '1d' or '15 minutes' into nanoseconds
+func parseInterval(str string) (ret int64, err error) {
+	str = strings.TrimSpace(str)
+	if m := intervalRegexp.FindStringSubmatch(str); m != nil {
+		unit := strings.ToLower(m[2])
+		d, ok := intervalUnits[unit]
+		if !ok && len(unit) > 1 && unit[len(unit)-1] == 's' {
+			d, ok = intervalUnits[unit[:len(unit)-1]]
+		}
+		if ok {
+			n, _ := strconv.ParseInt(m[1], 10, 64)
+			ret = n * int64(d)
+		}
+	} else if d, err1 := time.ParseDuration(str); err1 == nil {
+		ret = int64(d)
+	}
+	if ret <= 0 {
+		err = errors.New("Invalid interval '" + str + "'")
+	}
+	return
+}
+
+func compareValue(a interface{}, b interface{}) int {
+	if a1, ok := getInt(a); ok {
+		if b1, ok := getInt(b); ok {
+			if a1 < b1 {
+				return -1
+			} else if a1 > b1 {
+				return 1
+			}
+			return 0
+		}
+	}
+	if a1, ok := getFloat(a); ok {
+		if b1, ok := getFloat(b); ok {
+			if a1 < b1 {
+				return -1
+			} else if a1 > b1 {
+				return 1
+			}
+			return 0
+		}
+	}
+	switch a1 := a.(type) {
+	case string:
+		if b1, ok := b.(string); ok {
+			return strings.Compare(a1, b1)
+		}
+	case bool:
+		if b1, ok := b.(bool); ok {
+			if a1 == b1 {
+				return 0
+			} else if b1 {
+				return -1
+			}
+			return 1
+		}
+	case []byte:
+		if b1, ok := b.([]byte); ok {
+			return bytes.Compare(a1, b1)
+		}
+	case tuple.Tuple:
+		if b1, ok := b.(tuple.Tuple); ok {
+			for i := 0; i < len(a1) && i < len(b1); i++ {
+				if c := compareValue(a1[i], b1[i]); c != 0 {
+					return c
+				}
+			}
+			return len(a1) - len(b1)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package opentick
+
+import (
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_ParseInterval(t *testing.T) {
+	v, err := parseInterval("5m")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(300e9), v)
+	v, _ = parseInterval("15 minutes")
+	assert.Equal(t, int64(900e9), v)
+	v, _ = parseInterval("1d")
+	assert.Equal(t, int64(86400e9), v)
+	v, _ = parseInterval("100ms")
+	assert.Equal(t, int64(100e6), v)
+	v, _ = parseInterval("1h30m")
+	assert.Equal(t, int64(5400e9), v)
+	_, err = parseInterval("5x")
+	assert.Equal(t, "Invalid interval '5x'", err.Error())
+	_, err = parseInterval("0s")
+	assert.Equal(t, "Invalid interval '0s'", err.Error())
+}
+
+func Test_TimeBucket(t *testing.T) {
+	b := timeBucket{Interval: 300e9}
+	assert.Equal(t, tuple.Tuple{int64(300), int64(0)}, b.get(tuple.Tuple{int64(599), int64(999)}))
+	assert.Equal(t, tuple.Tuple{int64(-300), int64(0)}, b.get(tuple.Tuple{int64(-1), int64(0)}))
+	assert.Equal(t, nil, b.get(int64(1)))
+	s, err := parseSession("09:30-16:00", "America/New_York")
+	assert.Equal(t, nil, err)
+	b = timeBucket{Interval: 3600e9, Session: s}
+	// 2020-01-02 10:15 EST
+	ns := int64(1577978100e9)
+	assert.Equal(t, nsToTimestamp(ns-45*60e9), b.get(nsToTimestamp(ns)))
+	assert.Equal(t, nil, b.get(nsToTimestamp(ns-60*60e9)))
+	assert.Equal(t, nil, b.get(nsToTimestamp(ns+6*3600e9)))
+	s, _ = parseSession("18:00-05:00", "")
+	b = timeBucket{Interval: 3600e9, Session: s}
+	// 2020-01-02 01:30 UTC belongs to session started on 2020-01-01 18:00
+	ns = int64(1577928600e9)
+	assert.Equal(t, nsToTimestamp(ns-30*60e9), b.get(nsToTimestamp(ns)))
+	assert.Equal(t, nil, b.get(nsToTimestamp(ns+4*3600e9)))
+	_, err = parseSession("9:30", "")
+	assert.Equal(t, "Invalid session '9:30', HH:MM-HH:MM expected", err.Error())
+	_, err = parseSession("09:30-16:00", "Mars/Base")
+	assert.Equal(t, "Unknown time zone 'Mars/Base'", err.Error())
+}
+
+func Test_Aggregate(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "insert into _adj_ values(1, 300, 0.5, 2)", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for i, px := range []float64{10, 12, 9, 11, 20, 22, 21} {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?, ?)", []interface{}{1, i * 100, px, i + 1})
+		assert.Equal(t, nil, err)
+	}
+	_, err = Execute(db, "test", "insert into trade values(2, 0, 5, 100)", nil)
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select count(*), sum(qty), min(px), max(px), avg(qty), first(px), last(px) from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[7 28 9 22 4 10 21]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select count(*), sum(qty) from trade where sec=3", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0 <nil>]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, first(px), max(px), min(px), last(px), sum(qty) from trade where sec=1 group by bucket(time, '5m')", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[0 0] 10 12 9 9 6] [[300 0] 11 22 11 21 22]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, first(px), last(px) from trade where sec=1 group by bucket(time, '5m') limit -1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[300 0] 11 21]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, first(adj(px)), max(adj(px)), sum(adj(qty)) from trade where sec=1 group by bucket(time, '5m')", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[0 0] 5 6 12] [[300 0] 11 22 22]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, count(qty) from trade group by sec", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 7] [2 1]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select time, px from trade where sec=1 group by bucket(time, '5m')", nil)
+	assert.Equal(t, "Column px must appear in the GROUP BY clause or be used in an aggregate function", err.Error())
+	_, err = Execute(db, "test", "select sum(*) from trade where sec=1", nil)
+	assert.Equal(t, "Only count accepts *", err.Error())
+	_, err = Execute(db, "test", "select * from trade where sec=1 group by sec", nil)
+	assert.Equal(t, "Cannot select * with GROUP BY", err.Error())
+	_, err = Execute(db, "test", "select max(px) from trade where sec=1 group by bucket(px, '5m')", nil)
+	assert.Equal(t, "Invalid column px of Double for bucket, timestamp expected", err.Error())
+	_, err = Execute(db, "test", "select max(px), max(adj(px)) from trade where sec=1", nil)
+	assert.Equal(t, "Column px cannot be selected both with and without adj", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_Ohlcv(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "insert into _adj_ values(1, 300, 0.5, 2)", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for i, px := range []float64{10, 12, 9, 11, 20, 22, 21} {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?, ?)", []interface{}{1, i * 100, px, i + 1})
+		assert.Equal(t, nil, err)
+	}
+	_, err = Execute(db, "test", "insert into trade values(2, 0, 5, 100)", nil)
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select sec, ohlcv(px, qty, '5m') from trade", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 [0 0] 10 12 9 9 6 10.166666666666666 3] [1 [300 0] 11 22 11 21 22 19.227272727272727 4] [2 [0 0] 5 5 5 5 100 5 1]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select ohlcv(adj(px), adj(qty), '5m') from trade where sec=1 limit 1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[0 0] 5 6 4.5 4.5 12 5.083333333333333 3]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select ohlcv(px, qty, '2m', '00:01-00:05') from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[60 0] 12 12 12 12 2 12 1] [[180 0] 9 9 9 9 3 9 1]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select px, ohlcv(px, qty, '5m') from trade", nil)
+	assert.Equal(t, "Only leading primary keys can be selected before ohlcv", err.Error())
+	_, err = Execute(db, "test", "select ohlcv(px, qty, '5m') from trade group by sec", nil)
+	assert.Equal(t, "ohlcv cannot be used with GROUP BY", err.Error())
+	_, err = Execute(db, "test", "select ohlcv(sec, qty, '5m') from trade", nil)
+	assert.Equal(t, "Invalid column sec for ohlcv, primary key not allowed", err.Error())
+	_, err = Execute(db, "test", "select ohlcv(px, qty, '5m', '9-16') from trade", nil)
+	assert.Equal(t, "Invalid session '9-16', HH:MM-HH:MM expected", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
@@ -0,0 +1,660 @@
+package opentick
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Tables WITH (storage='block') pack consecutive rows of a key prefix into one key value pair.
+// The block key is the row key of its first row, so a row is always in the block at or before its key.
+// Blocks are split beyond maxBlockRows or maxBlockBytes, and merged with the next one below a quarter of maxBlockRows.
+var maxBlockRows = 256
+
+// encoded and compressed size of a block, below the 100KB value limit of FoundationDB
+var maxBlockBytes = 64 << 10
+
+const blockFormat = 1
+
+const (
+	blockColTuple = iota // packed tuple of column values
+	blockColXor          // float64 XORed with the previous one, zero bytes trimmed
+)
+
+var errCorruptedBlock = errors.New("Internal errror: corrupted block")
+
+// rows ascending by time of the last primary key
+type block struct {
+	Times  []int64
+	Values []tuple.Tuple
+}
+
+func (self *block) find(ns int64) (int, bool) {
+	i := sort.Search(len(self.Times), func(i int) bool { return self.Times[i] >= ns })
+	return i, i < len(self.Times) && self.Times[i] == ns
+}
+
+// insert or replace
+func (self *block) set(ns int64, value tuple.Tuple) {
+	i, ok := self.find(ns)
+	if ok {
+		self.Values[i] = value
+		return
+	}
+	self.Times = append(self.Times, 0)
+	self.Values = append(self.Values, nil)
+	copy(self.Times[i+1:], self.Times[i:])
+	copy(self.Values[i+1:], self.Values[i:])
+	self.Times[i] = ns
+	self.Values[i] = value
+}
+
+func (self *block) encode() []byte {
+	out := []byte{blockFormat}
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		out = append(out, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+	n := len(self.Times)
+	putUvarint(uint64(n))
+	// delta encoded times
+	out = append(out, tmp[:binary.PutVarint(tmp[:], self.Times[0])]...)
+	for i := 1; i < n; i++ {
+		putUvarint(uint64(self.Times[i] - self.Times[i-1]))
+	}
+	// rows written before columns added are shorter
+	ncols := 0
+	for _, v := range self.Values {
+		putUvarint(uint64(len(v)))
+		if len(v) > ncols {
+			ncols = len(v)
+		}
+	}
+	col := make(tuple.Tuple, 0, n)
+	for j := 0; j < ncols; j++ {
+		col = col[:0]
+		xor := true
+		for _, v := range self.Values {
+			if j < len(v) {
+				_, ok := v[j].(float64)
+				xor = xor && ok
+				col = append(col, v[j])
+			}
+		}
+		if !xor {
+			packed := col.Pack()
+			out = append(out, blockColTuple)
+			putUvarint(uint64(len(packed)))
+			out = append(out, packed...)
+			continue
+		}
+		out = append(out, blockColXor)
+		var prev uint64
+		for _, v := range col {
+			cur := math.Float64bits(v.(float64))
+			x := cur ^ prev
+			prev = cur
+			if x == 0 {
+				out = append(out, 0x80)
+				continue
+			}
+			lead := bits.LeadingZeros64(x) / 8
+			trail := bits.TrailingZeros64(x) / 8
+			out = append(out, byte(lead<<4|trail))
+			var be [8]byte
+			binary.BigEndian.PutUint64(be[:], x)
+			out = append(out, be[lead:8-trail]...)
+		}
+	}
+	return out
+}
+
+// times only, rest of data is returned for values
+func decodeBlockTimes(data []byte) (times []int64, rest []byte, err error) {
+	if len(data) == 0 || data[0] != blockFormat {
+		err = errCorruptedBlock
+		return
+	}
+	data = data[1:]
+	n, k := binary.Uvarint(data)
+	if k <= 0 || n == 0 || n > uint64(len(data)) {
+		err = errCorruptedBlock
+		return
+	}
+	data = data[k:]
+	t, k := binary.Varint(data)
+	if k <= 0 {
+		err = errCorruptedBlock
+		return
+	}
+	data = data[k:]
+	times = make([]int64, n)
+	times[0] = t
+	for i := 1; i < len(times); i++ {
+		d, k := binary.Uvarint(data)
+		if k <= 0 {
+			err = errCorruptedBlock
+			return
+		}
+		data = data[k:]
+		t += int64(d)
+		times[i] = t
+	}
+	rest = data
+	return
+}
+
+func decodeBlock(data []byte) (ret *block, err error) {
+	times, data, err := decodeBlockTimes(data)
+	if err != nil {
+		return
+	}
+	uvarint := func() uint64 {
+		v, k := binary.Uvarint(data)
+		if k <= 0 {
+			err = errCorruptedBlock
+			return 0
+		}
+		data = data[k:]
+		return v
+	}
+	n := len(times)
+	ret = &block{Times: times, Values: make([]tuple.Tuple, n)}
+	ncols := 0
+	lens := make([]int, n)
+	for i := 0; i < n && err == nil; i++ {
+		lens[i] = int(uvarint())
+		ret.Values[i] = make(tuple.Tuple, lens[i])
+		if lens[i] > ncols {
+			ncols = lens[i]
+		}
+	}
+	for j := 0; j < ncols && err == nil; j++ {
+		if len(data) == 0 {
+			err = errCorruptedBlock
+			break
+		}
+		tag := data[0]
+		data = data[1:]
+		switch tag {
+		case blockColTuple:
+			m := uvarint()
+			if err != nil || m > uint64(len(data)) {
+				err = errCorruptedBlock
+				break
+			}
+			col, err1 := tuple.Unpack(data[:m])
+			if err1 != nil {
+				err = errCorruptedBlock
+				break
+			}
+			data = data[m:]
+			k := 0
+			for i := range ret.Values {
+				if j < lens[i] {
+					if k >= len(col) {
+						err = errCorruptedBlock
+						break
+					}
+					ret.Values[i][j] = col[k]
+					k++
+				}
+			}
+		case blockColXor:
+			var prev uint64
+			for i := range ret.Values {
+				if j >= lens[i] {
+					continue
+				}
+				if len(data) == 0 {
+					err = errCorruptedBlock
+					break
+				}
+				h := data[0]
+				data = data[1:]
+				if h != 0x80 {
+					lead, trail := int(h>>4), int(h&0xF)
+					m := 8 - lead - trail
+					if lead+trail >= 8 || m > len(data) {
+						err = errCorruptedBlock
+						break
+					}
+					var be [8]byte
+					copy(be[lead:], data[:m])
+					data = data[m:]
+					prev ^= binary.BigEndian.Uint64(be[:])
+				}
+				ret.Values[i][j] = math.Float64frombits(prev)
+			}
+		default:
+			err = errCorruptedBlock
+		}
+	}
+	if err != nil {
+		ret = nil
+	}
+	return
+}
+
+func readBlock(schema *TableSchema, value []byte) (*block, error) {
+	value, err := schema.decompress(value)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(value)
+}
+
+// key prefix and time of the last primary key
+func splitBlockKey(schema *TableSchema, key fdb.KeyConvertible) (prefix tuple.Tuple, ns int64, err error) {
+	keys, err := schema.Dir.Unpack(key)
+	if err != nil {
+		return
+	}
+	n := len(keys) - 1
+	ns, ok := getTimestamp(keys[n])
+	if n+1 != len(schema.Keys) || !ok {
+		err = errors.New("Internal errror: invalid block key")
+		return
+	}
+	prefix = keys[:n:n]
+	return
+}
+
+func blockRowKey(schema *TableSchema, prefix tuple.Tuple, ns int64) fdb.Key {
+	return schema.Dir.Pack(append(prefix[:len(prefix):len(prefix)], nsToTimestamp(ns)))
+}
+
+func firstKV(tr fdb.ReadTransaction, kr fdb.KeyRange, reverse bool) (kv *fdb.KeyValue, err error) {
+	kvs, err := tr.GetRange(kr, fdb.RangeOptions{Limit: 1, Reverse: reverse}).GetSliceWithError()
+	if err == nil && len(kvs) > 0 {
+		kv = &kvs[0]
+	}
+	return
+}
+
+// blocks which may have rows in kr, from the one at or before kr.Begin
+func eachBlock(tr fdb.ReadTransaction, schema *TableSchema, kr fdb.KeyRange, reverse bool, fn func(kv fdb.KeyValue) (bool, error)) (err error) {
+	begin := kr.Begin.FDBKey()
+	dirBegin, _ := schema.Dir.FDBRangeKeys()
+	floor, err := firstKV(tr, fdb.KeyRange{Begin: dirBegin, End: append(begin[:len(begin):len(begin)], 0x00)}, true)
+	if err != nil {
+		return
+	}
+	if floor != nil {
+		begin = floor.Key
+	}
+	iter := tr.GetRange(fdb.KeyRange{Begin: begin, End: kr.End}, fdb.RangeOptions{Reverse: reverse}).Iterator()
+	for iter.Advance() {
+		kv, err1 := iter.Get()
+		if err1 != nil {
+			return err1
+		}
+		more, err1 := fn(kv)
+		if err1 != nil || !more {
+			return err1
+		}
+	}
+	return
+}
+
+// rows of kr in key order, expanded from blocks if the table is stored in blocks
+func getRange(tr fdb.ReadTransaction, schema *TableSchema, kr fdb.KeyRange, opts fdb.RangeOptions) (kvs []fdb.KeyValue, err error) {
+	if !schema.blocks() {
+		kvs, err = tr.GetRange(kr, opts).GetSliceWithError()
+		for i := 0; i < len(kvs) && err == nil; i++ {
+			kvs[i].Value, err = schema.decompress(kvs[i].Value)
+		}
+		return
+	}
+	begin, end := kr.Begin.FDBKey(), kr.End.FDBKey()
+	err = eachBlock(tr, schema, kr, opts.Reverse, func(kv fdb.KeyValue) (bool, error) {
+		prefix, _, err := splitBlockKey(schema, kv.Key)
+		if err != nil {
+			return false, err
+		}
+		b, err := readBlock(schema, kv.Value)
+		if err != nil {
+			return false, err
+		}
+		for k := range b.Times {
+			i := k
+			if opts.Reverse {
+				i = len(b.Times) - 1 - k
+			}
+			key := blockRowKey(schema, prefix, b.Times[i])
+			if bytes.Compare(key, begin) < 0 || bytes.Compare(key, end) >= 0 {
+				continue
+			}
+			kvs = append(kvs, fdb.KeyValue{Key: key, Value: b.Values[i].Pack()})
+			if opts.Limit > 0 && len(kvs) >= opts.Limit {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	return
+}
+
+// packed value of the row, nil if not found
+func getRow(tr fdb.ReadTransaction, schema *TableSchema, key fdb.Key) (value []byte, err error) {
+	if !schema.blocks() {
+		value, err = tr.Get(key).Get()
+		if err == nil {
+			value, err = schema.decompress(value)
+		}
+		return
+	}
+	kvs, err := getRange(tr, schema, fdb.KeyRange{Begin: key, End: append(key[:len(key):len(key)], 0x00)}, fdb.RangeOptions{})
+	if err == nil && len(kvs) > 0 {
+		value = kvs[0].Value
+	}
+	return
+}
+
+// values of keys, nil for missing rows and nil keys
+func getRows(tr fdb.ReadTransaction, schema *TableSchema, keys []fdb.Key) (values [][]byte, err error) {
+	values = make([][]byte, len(keys))
+	if schema.blocks() {
+		for i, key := range keys {
+			if key != nil {
+				if values[i], err = getRow(tr, schema, key); err != nil {
+					return
+				}
+			}
+		}
+		return
+	}
+	futs := make([]fdb.FutureByteSlice, len(keys))
+	for i, key := range keys {
+		if key != nil {
+			futs[i] = tr.Get(key)
+		}
+	}
+	for i, fut := range futs {
+		if fut != nil {
+			if values[i], err = fut.Get(); err != nil {
+				return
+			}
+			if values[i], err = schema.decompress(values[i]); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// iterates key values already read, same as fdb.RangeIterator
+type kvIterator struct {
+	kvs []fdb.KeyValue
+	i   int
+}
+
+func (self *kvIterator) Advance() bool {
+	self.i++
+	return self.i <= len(self.kvs)
+}
+
+func (self *kvIterator) Get() (fdb.KeyValue, error) {
+	return self.kvs[self.i-1], nil
+}
+
+// insert or replace rows, later one wins for duplicate keys.
+// Rows are sorted so that every block touched is read and written once.
+func setRows(tr fdb.Transaction, schema *TableSchema, keys []fdb.Key, values [][]byte) (err error) {
+	if !schema.blocks() {
+		for i := range keys {
+			tr.Set(keys[i], schema.compress(values[i]))
+		}
+		return
+	}
+	idx := make([]int, len(keys))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return bytes.Compare(keys[idx[a]], keys[idx[b]]) < 0 })
+	for i := 0; i < len(idx); {
+		key := keys[idx[i]]
+		prefix, _, err1 := splitBlockKey(schema, key)
+		if err1 != nil {
+			return err1
+		}
+		sub := schema.Dir.Sub(prefix...)
+		subBegin, subEnd := sub.FDBRangeKeys()
+		// the block at or before key, otherwise the first one of prefix if not full
+		old, err1 := firstKV(tr, fdb.KeyRange{Begin: subBegin, End: append(key[:len(key):len(key)], 0x00)}, true)
+		if err1 != nil {
+			return err1
+		}
+		if old == nil {
+			old, err1 = firstKV(tr, fdb.KeyRange{Begin: subBegin, End: subEnd}, false)
+			if err1 != nil {
+				return err1
+			}
+		}
+		b := &block{}
+		var oldKey fdb.Key
+		if old != nil {
+			b, err1 = readBlock(schema, old.Value)
+			if err1 != nil {
+				return err1
+			}
+			oldKey = old.Key
+			if bytes.Compare(oldKey, key) > 0 && len(b.Times) >= maxBlockRows {
+				b, oldKey = &block{}, nil
+			}
+		}
+		// rows before the next block go to b
+		after := key
+		if oldKey != nil && bytes.Compare(oldKey, key) > 0 {
+			after = oldKey
+		}
+		limit := fdb.Key(subEnd.FDBKey())
+		next, err1 := firstKV(tr, fdb.KeyRange{Begin: append(after[:len(after):len(after)], 0x00), End: subEnd}, false)
+		if err1 != nil {
+			return err1
+		}
+		if next != nil {
+			limit = next.Key
+		}
+		for ; i < len(idx) && bytes.Compare(keys[idx[i]], limit) < 0; i++ {
+			_, ns, err1 := splitBlockKey(schema, keys[idx[i]])
+			if err1 != nil {
+				return err1
+			}
+			value, err1 := tuple.Unpack(values[idx[i]])
+			if err1 != nil {
+				return errors.New("Internal errror: " + err1.Error())
+			}
+			b.set(ns, value)
+		}
+		err = writeBlock(tr, schema, prefix, oldKey, b)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// number of rows in [begin, end), only times of blocks are decoded
+// paged like countKeys, scanPageSize rows per transaction approximately
+func countBlockRows(db fdb.Transactor, schema *TableSchema, begin fdb.Key, end fdb.Key) (n int64, err error) {
+	pageBlocks := scanPageSize / maxBlockRows
+	if pageBlocks < 1 {
+		pageBlocks = 1
+	}
+	var last fdb.Key // last block counted
+	for {
+		var m int64
+		var last2 fdb.Key
+		_, err = db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, err error) {
+			m, last2 = 0, nil
+			nblocks := 0
+			fn := func(kv fdb.KeyValue) (bool, error) {
+				prefix, _, err := splitBlockKey(schema, kv.Key)
+				if err != nil {
+					return false, err
+				}
+				value, err := schema.decompress(kv.Value)
+				if err != nil {
+					return false, err
+				}
+				times, _, err := decodeBlockTimes(value)
+				if err != nil {
+					return false, err
+				}
+				if bytes.Compare(kv.Key, begin) >= 0 && bytes.Compare(blockRowKey(schema, prefix, times[len(times)-1]), end) < 0 {
+					m += int64(len(times))
+				} else {
+					for _, ns := range times {
+						key := blockRowKey(schema, prefix, ns)
+						if bytes.Compare(key, begin) >= 0 && bytes.Compare(key, end) < 0 {
+							m++
+						}
+					}
+				}
+				nblocks++
+				if nblocks >= pageBlocks {
+					last2 = kv.Key
+					return false, nil
+				}
+				return true, nil
+			}
+			if last == nil {
+				err = eachBlock(tr, schema, fdb.KeyRange{Begin: begin, End: end}, false, fn)
+				return
+			}
+			iter := tr.GetRange(fdb.KeyRange{Begin: append(last[:len(last):len(last)], 0x00), End: end}, fdb.RangeOptions{}).Iterator()
+			for iter.Advance() {
+				kv, err1 := iter.Get()
+				if err1 != nil {
+					return nil, err1
+				}
+				more, err1 := fn(kv)
+				if err1 != nil || !more {
+					return nil, err1
+				}
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+		n += m
+		if last2 == nil {
+			return
+		}
+		last = last2
+	}
+}
+
+func clearRow(tr fdb.Transaction, schema *TableSchema, key fdb.Key) (err error) {
+	if !schema.blocks() {
+		tr.Clear(key)
+		return
+	}
+	return clearRange(tr, schema, fdb.KeyRange{Begin: key, End: append(key[:len(key):len(key)], 0x00)})
+}
+
+func clearRange(tr fdb.Transaction, schema *TableSchema, kr fdb.KeyRange) (err error) {
+	if !schema.blocks() {
+		tr.ClearRange(kr)
+		return
+	}
+	begin, end := kr.Begin.FDBKey(), kr.End.FDBKey()
+	var blocks []fdb.KeyValue
+	err = eachBlock(tr, schema, kr, false, func(kv fdb.KeyValue) (bool, error) {
+		blocks = append(blocks, kv)
+		return true, nil
+	})
+	if err != nil {
+		return
+	}
+	// backwards, so that merged next blocks are already written
+	for k := len(blocks) - 1; k >= 0; k-- {
+		kv := blocks[k]
+		prefix, _, err1 := splitBlockKey(schema, kv.Key)
+		if err1 != nil {
+			return err1
+		}
+		b, err1 := readBlock(schema, kv.Value)
+		if err1 != nil {
+			return err1
+		}
+		b2 := &block{}
+		for i, ns := range b.Times {
+			key := blockRowKey(schema, prefix, ns)
+			if bytes.Compare(key, begin) < 0 || bytes.Compare(key, end) >= 0 {
+				b2.Times = append(b2.Times, ns)
+				b2.Values = append(b2.Values, b.Values[i])
+			}
+		}
+		if len(b2.Times) < len(b.Times) {
+			err = writeBlock(tr, schema, prefix, kv.Key, b2)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// replace the block of oldKey, split if too large and merged with the next one if too small
+func writeBlock(tr fdb.Transaction, schema *TableSchema, prefix tuple.Tuple, oldKey fdb.Key, b *block) (err error) {
+	if oldKey != nil {
+		tr.Clear(oldKey)
+	}
+	n := len(b.Times)
+	if n == 0 {
+		return
+	}
+	if n > maxBlockRows {
+		parts := (n + maxBlockRows - 1) / maxBlockRows
+		for k := 0; k < parts; k++ {
+			i, j := n*k/parts, n*(k+1)/parts
+			putBlock(tr, schema, prefix, &block{Times: b.Times[i:j], Values: b.Values[i:j]})
+		}
+		return
+	}
+	value := schema.compress(b.encode())
+	if n < maxBlockRows/4 && len(value) < maxBlockBytes {
+		key := blockRowKey(schema, prefix, b.Times[0])
+		_, subEnd := schema.Dir.Sub(prefix...).FDBRangeKeys()
+		next, err1 := firstKV(tr, fdb.KeyRange{Begin: append(key[:len(key):len(key)], 0x00), End: subEnd}, false)
+		if err1 != nil {
+			return err1
+		}
+		if next != nil && len(value)+len(next.Value) <= maxBlockBytes {
+			b2, err1 := readBlock(schema, next.Value)
+			if err1 != nil {
+				return err1
+			}
+			if n+len(b2.Times) <= maxBlockRows {
+				tr.Clear(next.Key)
+				b = &block{Times: append(b.Times, b2.Times...), Values: append(b.Values, b2.Values...)}
+				value = nil
+			}
+		}
+	}
+	if value == nil || len(value) > maxBlockBytes {
+		putBlock(tr, schema, prefix, b)
+	} else {
+		tr.Set(blockRowKey(schema, prefix, b.Times[0]), value)
+	}
+	return
+}
+
+// set b, halved until every part is within maxBlockBytes, a single row is set as is
+func putBlock(tr fdb.Transaction, schema *TableSchema, prefix tuple.Tuple, b *block) {
+	value := schema.compress(b.encode())
+	if n := len(b.Times); n > 1 && len(value) > maxBlockBytes {
+		putBlock(tr, schema, prefix, &block{Times: b.Times[:n/2], Values: b.Values[:n/2]})
+		putBlock(tr, schema, prefix, &block{Times: b.Times[n/2:], Values: b.Values[n/2:]})
+		return
+	}
+	tr.Set(blockRowKey(schema, prefix, b.Times[0]), value)
+}
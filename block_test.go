@@ -0,0 +1,181 @@
+package opentick
+
+import (
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"strings"
+	"testing"
+)
+
+func Test_EncodeBlock(t *testing.T) {
+	b := &block{
+		Times: []int64{-5, 0, 1e9, 1e9 + 1},
+		Values: []tuple.Tuple{
+			{1.5, int64(1), "a"},
+			{1.5, nil, "b"},
+			{-2.25},
+			{math.Inf(1), int64(-3), []byte{0, 1}, nil},
+		},
+	}
+	b2, err := decodeBlock(b.encode())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, b, b2)
+	b = &block{Times: []int64{7}, Values: []tuple.Tuple{{}}}
+	b2, err = decodeBlock(b.encode())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, b, b2)
+	data := b.encode()
+	_, err = decodeBlock(data[:len(data)-1])
+	assert.Equal(t, errCorruptedBlock, err)
+	_, err = decodeBlock([]byte{0})
+	assert.Equal(t, errCorruptedBlock, err)
+	b.set(3, tuple.Tuple{1.})
+	b.set(7, tuple.Tuple{2.})
+	assert.Equal(t, []int64{3, 7}, b.Times)
+	assert.Equal(t, []tuple.Tuple{{1.}, {2.}}, b.Values)
+}
+
+func Test_BlockStorage(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	n := maxBlockRows
+	maxBlockRows = 8
+	defer func() { maxBlockRows = n }()
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, qty int, primary key(sec)) with (storage='block')", nil)
+	assert.Equal(t, "Block storage requires the last primary key to be timestamp", err.Error())
+	_, err = Execute(db, "test", "create table trade(sec int, time timestamp, qty int, primary key(sec, time)) with (storage='col')", nil)
+	assert.Equal(t, "Invalid storage 'col', row or block expected", err.Error())
+	_, err = Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time)) with (storage='block')", nil)
+	assert.Equal(t, nil, err)
+	schema, err := GetTableSchema(db, "test", "trade")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, schema.blocks())
+	numBlocks := func() int {
+		a, b := schema.Dir.FDBRangeKeys()
+		kvs, _ := db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+			return tr.GetRange(fdb.KeyRange{Begin: a, End: b}, fdb.RangeOptions{}).GetSliceWithError()
+		})
+		return len(kvs.([]fdb.KeyValue))
+	}
+	// out of order, so that blocks are split in the middle
+	for _, i := range []int{9, 0, 5, 2, 7, 1, 8, 3, 6, 4} {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?, ?)", []interface{}{1, i, float64(i) / 2, i})
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, 2, numBlocks())
+	ret, err := Execute(db, "test", "select qty from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0] [1] [2] [3] [4] [5] [6] [7] [8] [9]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select px from trade where sec=1 and time>=3 and time<6", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1.5] [2] [2.5]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select qty from trade where sec=1 limit -2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[9] [8]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select qty from trade where sec=1 and time=4", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[4]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select count(*) from trade where sec=1 and time>2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[7]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "insert into trade values(1, 4, 0, 0), (1, 10, 5, 10) on conflict do nothing", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[true] [false]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "update trade set qty=40 where sec=1 and time=4", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "delete from trade where sec=1 and time>=1 and time<8", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "delete from trade where sec=1 and time=9", nil)
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select qty from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0] [8] [10]]", fmt.Sprint(ret))
+	// merged after delete
+	assert.Equal(t, 1, numBlocks())
+	argsArray := make([][]interface{}, 20)
+	for i := range argsArray {
+		argsArray[i] = []interface{}{2, i, 1.5, i}
+	}
+	ast, _ := Parse("insert into trade values(?, ?, ?, ?)")
+	stmt, err := resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	_, err = BatchInsert(db, &stmt, argsArray)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, numBlocks())
+	ret, err = Execute(db, "test", "select sum(qty), count(*) from trade where sec=2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[190 20]]", fmt.Sprint(ret))
+	// one block per transaction
+	pageSize := scanPageSize
+	scanPageSize = maxBlockRows
+	ret, err = Execute(db, "test", "select count(*) from trade where sec=2 and time>2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[17]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select count(*) from trade", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[23]]", fmt.Sprint(ret))
+	scanPageSize = pageSize
+	_, err = Execute(db, "test", "delete from trade", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, numBlocks())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_BlockBytes(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table news(sec int, time timestamp, body text, primary key(sec, time)) with (storage='block')", nil)
+	assert.Equal(t, nil, err)
+	schema, err := GetTableSchema(db, "test", "news")
+	assert.Equal(t, nil, err)
+	blocks := func() []fdb.KeyValue {
+		a, b := schema.Dir.FDBRangeKeys()
+		kvs, _ := db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+			return tr.GetRange(fdb.KeyRange{Begin: a, End: b}, fdb.RangeOptions{}).GetSliceWithError()
+		})
+		return kvs.([]fdb.KeyValue)
+	}
+	// far fewer rows than maxBlockRows, but too large for one value
+	body := strings.Repeat("x", 10000)
+	argsArray := make([][]interface{}, 30)
+	for i := range argsArray {
+		argsArray[i] = []interface{}{1, i, body}
+	}
+	ast, _ := Parse("insert into news values(?, ?, ?)")
+	stmt, err := resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	_, err = BatchInsert(db, &stmt, argsArray)
+	assert.Equal(t, nil, err)
+	kvs := blocks()
+	assert.Equal(t, true, len(kvs) >= 30*len(body)/maxBlockBytes)
+	for _, kv := range kvs {
+		assert.Equal(t, true, len(kv.Value) <= maxBlockBytes)
+	}
+	// a row larger than maxBlockBytes is a block alone
+	_, err = Execute(db, "test", "insert into news values(1, 100, ?)", []interface{}{strings.Repeat("y", 80000)})
+	assert.Equal(t, nil, err)
+	n := 0
+	for _, kv := range blocks() {
+		if len(kv.Value) > maxBlockBytes {
+			n++
+		}
+	}
+	assert.Equal(t, 1, n)
+	ret, err := Execute(db, "test", "select count(*) from news where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[31]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select body from news where sec=1 and time=29", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, body, ret[0][0])
+	ret, err = Execute(db, "test", "select time from news where sec=1 and time>27", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[28 0]] [[29 0]] [[100 0]]]", fmt.Sprint(ret))
+	Execute(db, "", "drop table test.news", nil)
+}
@@ -22,9 +22,18 @@ type Connection interface {
 	ExecuteAsync(sql string, args ...interface{}) (Future, error)
 	BatchInsert(sql string, argsArray [][]interface{}) (err error)
 	BatchInsertAsync(sql string, argsArray [][]interface{}) (Future, error)
+	Query(sql string, args ...interface{}) (Rows, error)
 	Close()
 }
 
+// row iterator of a streamed select, rows are available as soon as the first frame arrives
+type Rows interface {
+	Next() bool // false at the end or on error
+	Row() []interface{}
+	Err() error
+	Close() // discard the remaining rows
+}
+
 func Connect(host string, port int, dbName string) (ret Connection, err error) {
 	raddr, err1 := net.ResolveTCPAddr("tcp", host+":"+strconv.FormatInt(int64(port), 10))
 	if err1 != nil {
@@ -44,6 +53,7 @@ func Connect(host string, port int, dbName string) (ret Connection, err error) {
 	c := &connection{
 		conn:      conn,
 		store:     make(map[int]interface{}),
+		streams:   make(map[int]*stream),
 		mutexCond: m,
 		cond:      sync.NewCond(m),
 	}
@@ -168,6 +178,11 @@ func (self *future) Get(timeout ...float64) (ret [][]interface{}, err error) {
 	if res == nil || err != nil {
 		return
 	}
+	ret = convertRows(res)
+	return
+}
+
+func convertRows(res interface{}) (ret [][]interface{}) {
 	if res2, ok := res.([]interface{}); ok {
 		for _, rec := range res2 {
 			if rec2, ok2 := rec.([]interface{}); ok2 {
@@ -189,11 +204,119 @@ func (self *future) Get(timeout ...float64) (ret [][]interface{}, err error) {
 	return
 }
 
+// frames of a streamed ticket, in order of arrival, every consumed frame is acked so that
+// the server sends a bounded number of frames ahead
+type stream struct {
+	frames []map[string]interface{}
+	closed bool
+}
+
+type rows struct {
+	ticket int
+	conn   *connection
+	stream *stream
+	seq    int
+	rows   [][]interface{}
+	row    []interface{}
+	done   bool
+	err    error
+}
+
+func (self *rows) Next() bool {
+	for len(self.rows) == 0 {
+		if self.done || !self.nextFrame() {
+			self.row = nil
+			return false
+		}
+	}
+	self.row = self.rows[0]
+	self.rows = self.rows[1:]
+	return true
+}
+
+func (self *rows) Row() []interface{} {
+	return self.row
+}
+
+func (self *rows) Err() error {
+	return self.err
+}
+
+func (self *rows) Close() {
+	c := self.conn
+	c.mutexCond.Lock()
+	cancel := false
+	if !self.done {
+		self.done = true
+		cancel = true
+		for _, frame := range self.stream.frames {
+			if end, _ := frame["4"].(bool); end {
+				delete(c.streams, self.ticket)
+				cancel = false
+			}
+		}
+		// the remaining frames are dropped by recv until the end frame
+		self.stream.closed = true
+		self.stream.frames = nil
+	}
+	self.rows = nil
+	c.mutexCond.Unlock()
+	if cancel {
+		c.send(map[string]interface{}{"0": self.ticket, "1": "ack", "2": 0})
+	}
+}
+
+func (self *rows) finish(err error) bool {
+	self.err = err
+	self.done = true
+	delete(self.conn.streams, self.ticket)
+	return false
+}
+
+func (self *rows) nextFrame() bool {
+	c := self.conn
+	c.mutexCond.Lock()
+	defer c.mutexCond.Unlock()
+	for len(self.stream.frames) == 0 {
+		if tmp, ok := c.store[-1]; ok && tmp != nil {
+			return self.finish(tmp.(error))
+		}
+		c.cond.Wait()
+	}
+	frame := self.stream.frames[0]
+	self.stream.frames = self.stream.frames[1:]
+	if _, ok := frame["3"]; !ok {
+		// plain reply of the ticket, e.g. invalid ack
+		str, _ := frame["1"].(string)
+		return self.finish(errors.New(str))
+	}
+	if seq, _ := frame["3"].(int); seq != self.seq {
+		return self.finish(errors.New("Stream frame out of order"))
+	}
+	if end, _ := frame["4"].(bool); end {
+		var err error
+		if str, ok := frame["1"].(string); ok {
+			err = errors.New(str)
+		}
+		return self.finish(err)
+	}
+	self.seq++
+	c.mutexCond.Unlock()
+	err := c.send(map[string]interface{}{"0": self.ticket, "1": "ack", "2": 1})
+	c.mutexCond.Lock()
+	if err != nil {
+		return self.finish(err)
+	}
+	self.rows = convertRows(frame["1"])
+	return true
+}
+
 type connection struct {
 	conn          net.Conn
 	ticketCounter int64
 	prepared      sync.Map
 	store         map[int]interface{}
+	streams       map[int]*stream
 	mutex         sync.Mutex
 	cond          *sync.Cond
 	mutexCond     *sync.Mutex
@@ -360,6 +483,35 @@ func (self *connection) ExecuteAsync(sql string, args ...interface{}) (ret Futur
 	return
 }
 
+func (self *connection) Query(sql string, args ...interface{}) (ret Rows, err error) {
+	prepared := -1
+	if len(args) > 0 {
+		convertTimestamp(args)
+		prepared, err = self.prepare(sql)
+		if err != nil {
+			return
+		}
+	}
+	ticket := self.getTicket()
+	cmd := map[string]interface{}{"0": ticket, "1": "stream", "2": sql, "3": args}
+	if prepared >= 0 {
+		cmd["2"] = prepared
+	}
+	s := &stream{}
+	self.mutexCond.Lock()
+	self.streams[ticket] = s
+	self.mutexCond.Unlock()
+	err = self.send(cmd)
+	if err != nil {
+		self.mutexCond.Lock()
+		delete(self.streams, ticket)
+		self.mutexCond.Unlock()
+		return
+	}
+	ret = &rows{ticket: ticket, conn: self, stream: s}
+	return
+}
+
 func (self *connection) getTicket() int {
 	return int(atomic.AddInt64(&self.ticketCounter, 1))
 }
@@ -390,6 +542,23 @@ func (self *connection) send(data map[string]interface{}) error {
 	return nil
 }
 
+// queue the frame if ticket is streamed, false otherwise
+func (self *connection) notifyStream(ticket int, frame map[string]interface{}) bool {
+	self.mutexCond.Lock()
+	defer self.mutexCond.Unlock()
+	s, ok := self.streams[ticket]
+	if !ok {
+		return false
+	}
+	if !s.closed {
+		s.frames = append(s.frames, frame)
+	} else if end, _ := frame["4"].(bool); end {
+		delete(self.streams, ticket)
+	}
+	self.cond.Broadcast()
+	return true
+}
+
 func (self *connection) notify(ticket int, msg interface{}) {
 	self.mutexCond.Lock()
 	self.store[ticket] = msg
@@ -461,6 +630,10 @@ func recv(c *connection) {
 			data["1"] = cacheData["1"]
 			delete(data, "2")
 		}
-		c.notify(data["0"].(int), data)
+		ticket := data["0"].(int)
+		if c.notifyStream(ticket, data) {
+			continue
+		}
+		c.notify(ticket, data)
 	}
 }
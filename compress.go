@@ -0,0 +1,147 @@
+package opentick
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Values of tables WITH (compression='zstd'|'lz4') are prefixed by one byte,
+// raw if compression does not make it smaller
+const (
+	valueRaw = iota
+	valueCompressed
+)
+
+const maxDecompressedSize = 1 << 24
+
+var errCorruptedValue = errors.New("Internal errror: corrupted compressed value")
+
+type compressor interface {
+	compress(data []byte) []byte
+	decompress(data []byte) ([]byte, error)
+}
+
+var compressors = map[string]compressor{
+	"zstd": zstdCompressor{},
+	"lz4":  lz4Compressor{},
+}
+
+// safe for concurrent EncodeAll and DecodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) compress(data []byte) []byte {
+	return zstdEncoder.EncodeAll(data, nil)
+}
+
+func (zstdCompressor) decompress(data []byte) ([]byte, error) {
+	out, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, errCorruptedValue
+	}
+	return out, nil
+}
+
+// decompressed size, then the lz4 block, nil if incompressible
+type lz4Compressor struct{}
+
+func (lz4Compressor) compress(data []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	k := binary.PutUvarint(tmp[:], uint64(len(data)))
+	out := make([]byte, k+lz4.CompressBlockBound(len(data)))
+	copy(out, tmp[:k])
+	n, err := lz4.CompressBlock(data, out[k:], nil)
+	if err != nil || n == 0 {
+		return nil
+	}
+	return out[:k+n]
+}
+
+func (lz4Compressor) decompress(data []byte) ([]byte, error) {
+	n, k := binary.Uvarint(data)
+	if k <= 0 || n > maxDecompressedSize {
+		return nil, errCorruptedValue
+	}
+	out := make([]byte, n)
+	m, err := lz4.UncompressBlock(data[k:], out)
+	if err != nil || uint64(m) != n {
+		return nil, errCorruptedValue
+	}
+	return out, nil
+}
+
+func (self *TableSchema) compressor() compressor {
+	return compressors[self.Options["compression"]]
+}
+
+func (self *TableSchema) compress(value []byte) []byte {
+	c := self.compressor()
+	if c == nil {
+		return value
+	}
+	out := c.compress(value)
+	if out == nil || len(out) >= len(value) {
+		return append([]byte{valueRaw}, value...)
+	}
+	return append([]byte{valueCompressed}, out...)
+}
+
+func (self *TableSchema) decompress(value []byte) ([]byte, error) {
+	c := self.compressor()
+	if c == nil || value == nil {
+		return value, nil
+	}
+	if len(value) == 0 {
+		return nil, errCorruptedValue
+	}
+	switch value[0] {
+	case valueRaw:
+		return value[1:], nil
+	case valueCompressed:
+		return c.decompress(value[1:])
+	}
+	return nil, errCorruptedValue
+}
+
+// decompresses values of fdb.RangeIterator
+type decompressIterator struct {
+	*fdb.RangeIterator
+	schema *TableSchema
+}
+
+func (self decompressIterator) Get() (kv fdb.KeyValue, err error) {
+	kv, err = self.RangeIterator.Get()
+	if err == nil {
+		kv.Value, err = self.schema.decompress(kv.Value)
+	}
+	return
+}
+
+const compressionSampleSize = 1000
+
+// raw and stored sizes of the first values of the table
+func sampleCompression(db fdb.Transactor, schema *TableSchema) (raw int64, stored int64, err error) {
+	_, err = db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, err error) {
+		raw, stored = 0, 0
+		a, b := schema.Dir.FDBRangeKeys()
+		kvs, err := tr.GetRange(fdb.KeyRange{Begin: a, End: b}, fdb.RangeOptions{Limit: compressionSampleSize}).GetSliceWithError()
+		if err != nil {
+			return
+		}
+		for _, kv := range kvs {
+			value, err1 := schema.decompress(kv.Value)
+			if err1 != nil {
+				return nil, err1
+			}
+			raw += int64(len(value))
+			stored += int64(len(kv.Value))
+		}
+		return
+	})
+	return
+}
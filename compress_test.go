@@ -0,0 +1,124 @@
+package opentick
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func Test_Lz4(t *testing.T) {
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		[]byte("abc"),
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("0123456789abcdef"), 100),
+		random,
+		append(append([]byte{}, random[:300]...), random[:600]...),
+	}
+	var c lz4Compressor
+	for _, src := range inputs {
+		packed := c.compress(src)
+		out, err := c.decompress(packed)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, bytes.Equal(src, out))
+	}
+	packed := c.compress(inputs[2])
+	assert.Equal(t, true, len(packed) < 100)
+	// decompressed size 100 instead of 1600
+	_, err := c.decompress(append([]byte{100}, packed[2:]...))
+	assert.Equal(t, errCorruptedValue, err)
+	_, err = c.decompress(packed[:len(packed)-3])
+	assert.Equal(t, errCorruptedValue, err)
+	_, err = c.decompress([]byte{0xff, 0xff, 0xff, 0xff, 0x7f})
+	assert.Equal(t, errCorruptedValue, err)
+}
+
+// malformed blocks must fail without panic or out of bounds writes
+func Test_Lz4Malformed(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var c lz4Compressor
+	valid := c.compress(bytes.Repeat([]byte("0123456789abcdef"), 100))
+	for i := 0; i < 20000; i++ {
+		var data []byte
+		switch i % 3 {
+		case 0:
+			data = make([]byte, r.Intn(64))
+			r.Read(data)
+		case 1:
+			data = append([]byte{}, valid[:r.Intn(len(valid))]...)
+		default:
+			data = append([]byte{}, valid...)
+			data[r.Intn(len(data))] ^= byte(1 + r.Intn(255))
+		}
+		out, err := c.decompress(data)
+		if err == nil {
+			n, _ := binary.Uvarint(data)
+			assert.Equal(t, int(n), len(out))
+		}
+	}
+}
+
+func Test_CompressValue(t *testing.T) {
+	value := tuple.Tuple{1.5, 1.5, 1.5, 1.5, 1.5, 1.5, 1.5, 1.5, "abcabcabcabcabcabcabc"}.Pack()
+	for _, name := range []string{"zstd", "lz4"} {
+		schema := &TableSchema{Options: map[string]string{"compression": name}}
+		packed := schema.compress(value)
+		assert.Equal(t, byte(valueCompressed), packed[0])
+		assert.Equal(t, true, len(packed) < len(value))
+		out, err := schema.decompress(packed)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, value, out)
+		packed = schema.compress([]byte{0x21})
+		assert.Equal(t, []byte{valueRaw, 0x21}, packed)
+		out, err = schema.decompress(packed)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, []byte{0x21}, out)
+		_, err = schema.decompress([]byte{2})
+		assert.Equal(t, errCorruptedValue, err)
+	}
+	schema := &TableSchema{}
+	assert.Equal(t, value, schema.compress(value))
+}
+
+func Test_Compression(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table bar(sec int, time timestamp, px double, primary key(sec, time)) with (compression='gzip')", nil)
+	assert.Equal(t, "Invalid compression 'gzip', zstd, lz4 or none expected", err.Error())
+	for _, sql := range []string{
+		"create table bar(sec int, time timestamp, open double, high double, low double, close double, note text, primary key(sec, time)) with (compression='zstd')",
+		"create table bar(sec int, time timestamp, open double, high double, low double, close double, note text, primary key(sec, time)) with (compression='lz4', storage='block')",
+	} {
+		_, err = Execute(db, "test", sql, nil)
+		assert.Equal(t, nil, err)
+		for i := 0; i < 10; i++ {
+			_, err = Execute(db, "test", "insert into bar values(1, ?, 1.5, 1.5, 1.5, 1.5, 'unchanged unchanged unchanged')", []interface{}{i})
+			assert.Equal(t, nil, err)
+		}
+		_, err = Execute(db, "test", "update bar set close=2.5 where sec=1 and time=3", nil)
+		assert.Equal(t, nil, err)
+		ret, err := Execute(db, "test", "select close from bar where sec=1 and time>=2 and time<5", nil)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "[[1.5] [2.5] [1.5]]", fmt.Sprint(ret))
+		ret, err = Execute(db, "test", "select time from bar where close > 2 allow filtering", nil)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 1, len(ret))
+		ret, err = Execute(db, "test", "insert into bar(sec, time, close) values(1, 3, 0) if not exists", nil)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "[[true]]", fmt.Sprint(ret))
+		schema, err := GetTableSchema(db, "test", "bar")
+		assert.Equal(t, nil, err)
+		raw, stored, err := sampleCompression(db, schema)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, raw > stored)
+		Execute(db, "", "drop table test.bar", nil)
+	}
+}
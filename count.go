@@ -0,0 +1,153 @@
+package opentick
+
+import (
+	"bytes"
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"sort"
+)
+
+// count(*) counts keys without unpacking records, approx_count(*) counts the first, the last and
+// one middle shard of every range and extrapolates by shard boundaries of LocalityGetBoundaryKeys,
+// since GetEstimatedRangeSizeBytes is not available in API version 520.
+// Both are paged across transactions, so large ranges do not hit the 5 seconds limit
+
+func resolveCount(stmt *selectStmt) (err error) {
+	approx := false
+	for _, a := range stmt.Aggs {
+		if a != nil && a.Name == "approx_count" {
+			approx = true
+		}
+	}
+	plain := len(stmt.Cols) == 1 && stmt.Cols[0] == nil && stmt.GroupBy == nil && stmt.Bucket == nil
+	if !plain {
+		if approx {
+			err = errors.New("approx_count(*) cannot be used with other columns or GROUP BY")
+		}
+		return
+	}
+	hasFilters := false
+	for _, branch := range stmt.Where {
+		if branch.Filters != nil {
+			hasFilters = true
+		}
+	}
+	if approx && hasFilters {
+		return errors.New("approx_count(*) cannot be used with ALLOW FILTERING")
+	}
+	if !hasFilters {
+		stmt.Count = stmt.Aggs[0].Name
+	}
+	return
+}
+
+func rangeKeys(r *whereRange) (begin fdb.Key, end fdb.Key) {
+	if r.Key != nil {
+		return fdb.Key(r.Key), fdb.Key(append(append([]byte{}, r.Key...), 0x00))
+	}
+	a, b := r.Range.FDBRangeKeys()
+	return a.FDBKey(), b.FDBKey()
+}
+
+// overlapped ranges of or branches must be merged by reading records
+func disjointRanges(ranges []whereRange) bool {
+	keys := make([][2]fdb.Key, len(ranges))
+	for i := range ranges {
+		keys[i][0], keys[i][1] = rangeKeys(&ranges[i])
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][0], keys[j][0]) < 0 })
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1][1], keys[i][0]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func executeCount(db fdb.Transactor, stmt *selectStmt, ranges []whereRange) (res [][]interface{}, err error) {
+	var n int64
+	for i := range ranges {
+		begin, end := rangeKeys(&ranges[i])
+		var m int64
+		if stmt.Schema.blocks() {
+			// blocks are few, so approx_count is exact too
+			m, err = countBlockRows(db, stmt.Schema, begin, end)
+		} else if stmt.Count == "approx_count" {
+			m, err = approxCountKeys(db, begin, end)
+		} else {
+			m, err = countKeys(db, begin, end)
+		}
+		if err != nil {
+			return
+		}
+		n += m
+	}
+	if stmt.Offset > 0 {
+		return
+	}
+	res = [][]interface{}{{n}}
+	return
+}
+
+// page by page like scanRanges, every page in its own transaction resuming after the last key counted
+func countKeys(db fdb.Transactor, begin fdb.Key, end fdb.Key) (n int64, err error) {
+	for {
+		var m int
+		var last fdb.Key
+		_, err = db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, err error) {
+			kvs, err := tr.GetRange(fdb.KeyRange{Begin: begin, End: end}, fdb.RangeOptions{Limit: scanPageSize}).GetSliceWithError()
+			if err != nil {
+				return
+			}
+			m = len(kvs)
+			last = nil
+			if m == scanPageSize {
+				last = kvs[m-1].Key
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+		n += int64(m)
+		if last == nil {
+			return
+		}
+		begin = append(last[:len(last):len(last)], 0x00)
+	}
+}
+
+func approxCountKeys(db fdb.Transactor, begin fdb.Key, end fdb.Key) (n int64, err error) {
+	database, ok := db.(fdb.Database)
+	if !ok {
+		return countKeys(db, begin, end)
+	}
+	boundaries, err := database.LocalityGetBoundaryKeys(fdb.KeyRange{Begin: begin, End: end}, 0, 0)
+	if err != nil {
+		return
+	}
+	points := []fdb.Key{begin}
+	for _, k := range boundaries {
+		if bytes.Compare(k, begin) > 0 && bytes.Compare(k, end) < 0 {
+			points = append(points, k)
+		}
+	}
+	points = append(points, end)
+	nshards := len(points) - 1
+	if nshards <= 3 {
+		return countKeys(db, begin, end)
+	}
+	// partial first and last shards counted exactly, full shards by the middle one
+	for _, i := range []int{0, nshards - 1} {
+		m, err1 := countKeys(db, points[i], points[i+1])
+		if err1 != nil {
+			err = err1
+			return
+		}
+		n += m
+	}
+	i := nshards / 2
+	m, err := countKeys(db, points[i], points[i+1])
+	n += m * int64(nshards-2)
+	return
+}
@@ -0,0 +1,67 @@
+package opentick
+
+import (
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_DisjointRanges(t *testing.T) {
+	r := func(a string, b string) whereRange {
+		return whereRange{Range: fdb.KeyRange{Begin: fdb.Key(a), End: fdb.Key(b)}}
+	}
+	assert.Equal(t, true, disjointRanges([]whereRange{r("c", "d"), r("a", "b"), r("b", "c")}))
+	assert.Equal(t, false, disjointRanges([]whereRange{r("a", "c"), r("b", "d")}))
+	assert.Equal(t, true, disjointRanges([]whereRange{{Key: []byte("a")}, r("a\x00", "b")}))
+	assert.Equal(t, false, disjointRanges([]whereRange{{Key: []byte("b")}, r("a", "c")}))
+}
+
+func Test_Count(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for i := 0; i < 10; i++ {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?)", []interface{}{i % 3, i, float64(i)})
+		assert.Equal(t, nil, err)
+	}
+	ret, err := Execute(db, "test", "select count(*) from trade", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[10]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select count(*) from trade where sec in (0, 2) and time > 2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[5]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select count(*) from trade where sec=1 or sec=1 and time>3", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[3]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select count(*) * 2 from trade where sec=0 and time=3", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[2]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select count(*) from trade where px > 6 allow filtering", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[3]]", fmt.Sprint(ret))
+	// counted across transactions
+	pageSize := scanPageSize
+	scanPageSize = 2
+	ret, err = Execute(db, "test", "select count(*) from trade where sec in (0, 2) and time > 2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[5]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select count(*) from trade", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[10]]", fmt.Sprint(ret))
+	scanPageSize = pageSize
+	// small ranges are counted exactly
+	ret, err = Execute(db, "test", "select approx_count(*) from trade where sec=0", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[4]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select sec, approx_count(*) from trade group by sec", nil)
+	assert.Equal(t, "approx_count(*) cannot be used with other columns or GROUP BY", err.Error())
+	_, err = Execute(db, "test", "select approx_count(px) from trade", nil)
+	assert.Equal(t, "approx_count only accepts *", err.Error())
+	_, err = Execute(db, "test", "select approx_count(*) from trade where px > 6 allow filtering", nil)
+	assert.Equal(t, "approx_count(*) cannot be used with ALLOW FILTERING", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
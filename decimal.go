@@ -0,0 +1,89 @@
+package opentick
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// DECIMAL(p,s) is stored as int64 scaled by 10^s, so that key order and comparison stay exact
+const maxDecimalPrecision = 18
+
+var pow10 = func() (ret [maxDecimalPrecision + 1]int64) {
+	ret[0] = 1
+	for i := 1; i < len(ret); i++ {
+		ret[i] = ret[i-1] * 10
+	}
+	return
+}()
+
+// parse plain decimal string, rounded half away from zero
+func parseDecimal(str string, precision uint32, scale uint32) (ret int64, err error) {
+	s := strings.TrimSpace(str)
+	neg := false
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" && fracPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		err = errors.New("Invalid decimal value '" + str + "'")
+		return
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if len(intPart)+int(scale) > int(precision) {
+		err = errors.New("Decimal value " + str + " out of range")
+		return
+	}
+	round := false
+	if len(fracPart) > int(scale) {
+		round = fracPart[scale] >= '5'
+		fracPart = fracPart[:scale]
+	} else {
+		fracPart += strings.Repeat("0", int(scale)-len(fracPart))
+	}
+	if digits := intPart + fracPart; digits != "" {
+		ret, _ = strconv.ParseInt(digits, 10, 64)
+	}
+	if round {
+		ret++
+		if ret >= pow10[precision] {
+			err = errors.New("Decimal value " + str + " out of range")
+			return
+		}
+	}
+	if neg {
+		ret = -ret
+	}
+	return
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func formatDecimal(v int64, scale uint32) string {
+	if scale == 0 {
+		return strconv.FormatInt(v, 10)
+	}
+	sign := ""
+	u := uint64(v)
+	if v < 0 {
+		sign = "-"
+		u = uint64(-v)
+	}
+	s := strconv.FormatUint(u, 10)
+	if len(s) <= int(scale) {
+		s = strings.Repeat("0", int(scale)-len(s)+1) + s
+	}
+	n := len(s) - int(scale)
+	return sign + s[:n] + "." + s[n:]
+}
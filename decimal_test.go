@@ -0,0 +1,48 @@
+package opentick
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_Decimal(t *testing.T) {
+	v, err := parseDecimal("1.23456", 10, 4)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(12346), v)
+	v, err = parseDecimal("-1.23455", 10, 4)
+	assert.Equal(t, int64(-12346), v)
+	v, err = parseDecimal(".5", 3, 0)
+	assert.Equal(t, int64(1), v)
+	v, err = parseDecimal("007", 3, 2)
+	assert.Equal(t, int64(700), v)
+	_, err = parseDecimal("10", 3, 2)
+	assert.NotEqual(t, nil, err)
+	_, err = parseDecimal("9.995", 3, 2)
+	assert.NotEqual(t, nil, err)
+	_, err = parseDecimal("1e3", 10, 2)
+	assert.NotEqual(t, nil, err)
+	_, err = parseDecimal(".", 10, 2)
+	assert.NotEqual(t, nil, err)
+	v, err = parseDecimal("999999999999999999", 18, 0)
+	assert.Equal(t, int64(999999999999999999), v)
+	assert.Equal(t, "1.2346", formatDecimal(12346, 4))
+	assert.Equal(t, "-0.0012", formatDecimal(-12, 4))
+	assert.Equal(t, "0.5", formatDecimal(5, 1))
+	assert.Equal(t, "12", formatDecimal(12, 0))
+	col, _ := newTableColDef("px", "decimal", []int64{6, 2})
+	v2, err := validateValue(col, 1.005, false)
+	assert.Equal(t, int64(101), v2)
+	v2, err = validateValue(col, 3, false)
+	assert.Equal(t, int64(300), v2)
+	_, err = validateValue(col, "12345", false)
+	assert.Equal(t, "Invalid value (12345) for \"px\" of Decimal(6,2)", err.Error())
+	col = NewTableColDef("raw", Blob)
+	v2, err = validateValue(col, "ab", false)
+	assert.Equal(t, []byte("ab"), v2)
+	assert.Equal(t, -1, compareValue([]byte("ab"), []byte("b")))
+	col = NewTableColDef("sec", Symbol)
+	v2, err = validateValue(col, "AAPL", false)
+	assert.Equal(t, symbol("AAPL"), v2)
+	_, err = validateValue(col, 1, false)
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,149 @@
+package opentick
+
+import (
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+)
+
+// SELECT DISTINCT of leading primary keys skip-scans the key space,
+// jumping over all rows of a prefix once its first row is read
+
+func checkDistinct(ast *AstSelect, items []AstSelectCol) (err error) {
+	if ast.Join != nil {
+		return errors.New("DISTINCT cannot be used with ASOF JOIN")
+	}
+	if ast.GroupBy != nil {
+		return errors.New("DISTINCT cannot be used with GROUP BY")
+	}
+	if ast.LatestBy != nil {
+		return errors.New("DISTINCT cannot be used with LATEST BY")
+	}
+	if ast.Selected.All != nil {
+		return errors.New("DISTINCT only supports leading primary keys")
+	}
+	for _, col := range items {
+		if col.Agg != nil || col.Ohlcv != nil {
+			return errors.New("DISTINCT only supports leading primary keys")
+		}
+	}
+	return
+}
+
+func resolveDistinct(stmt *selectStmt) (err error) {
+	used := make([]bool, len(stmt.Schema.Keys))
+	n := 0
+	for j, col := range stmt.Cols {
+		if !col.IsKey || stmt.Funcs[j] != nil && stmt.Funcs[j].Loc == nil {
+			return errors.New("DISTINCT only supports leading primary keys")
+		}
+		if !used[col.Pos] {
+			used[col.Pos] = true
+			n++
+		}
+	}
+	for _, u := range used[:n] {
+		if !u {
+			return errors.New("DISTINCT only supports leading primary keys")
+		}
+	}
+	stmt.Distinct = n
+	return
+}
+
+// every round trip of the skip-scan reads at most this many key-values,
+// and takes as many of scanPageSize of the transaction
+var distinctStep = 100
+
+// prefixes read in one transaction, kr is where to resume if not done
+type distinctPage struct {
+	recs []record
+	kr   fdb.KeyRange
+	done bool
+}
+
+// first record of every prefix of n keys in r, at most limit prefixes if limit > 0,
+// paged like scanRanges, every page in its own transaction resuming after the last prefix read
+func readDistinct(db fdb.Transactor, schema *TableSchema, r *whereRange, n int, limit int, reverse bool) (recs []record, err error) {
+	if r.Key != nil {
+		tmp, err1 := db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+			return readRange(tr, schema, r, 1, reverse)
+		})
+		if err1 != nil {
+			err = err1
+			return
+		}
+		recs = tmp.([]record)
+		return
+	}
+	kr := r.Range
+	for limit <= 0 || len(recs) < limit {
+		m := 0
+		if limit > 0 {
+			m = limit - len(recs)
+		}
+		tmp, err1 := db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+			return readDistinctPage(tr, schema, kr, r.Filters, n, m, reverse)
+		})
+		if err1 != nil {
+			err = err1
+			return
+		}
+		page := tmp.(distinctPage)
+		recs = append(recs, page.recs...)
+		if page.done {
+			break
+		}
+		kr = page.kr
+	}
+	return
+}
+
+func readDistinctPage(tr fdb.Transaction, schema *TableSchema, kr fdb.KeyRange, filters []filter, n int, limit int, reverse bool) (page distinctPage, err error) {
+	for budget := scanPageSize; budget > 0 && (limit <= 0 || len(page.recs) < limit); budget -= distinctStep {
+		opts := fdb.RangeOptions{Limit: 1, Reverse: reverse}
+		if filters != nil {
+			opts.Limit = distinctStep
+		}
+		kvs, err1 := getRange(tr, schema, kr, opts)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		found := false
+		for _, kv := range kvs {
+			rec, err2 := unpackRecord(schema, kv)
+			if err2 != nil {
+				err = err2
+				return
+			}
+			if !matchFilters(filters, rec) {
+				continue
+			}
+			page.recs = append(page.recs, record{kv.Key, rec})
+			begin, end := schema.Dir.Sub(rec[0][:n]...).FDBRangeKeys()
+			if reverse {
+				kr.End = begin
+			} else {
+				kr.Begin = end
+			}
+			found = true
+			break
+		}
+		if found {
+			continue
+		}
+		if len(kvs) < opts.Limit {
+			page.done = true
+			return
+		}
+		// all filtered out, resume after them
+		last := kvs[len(kvs)-1].Key
+		if reverse {
+			kr.End = last
+		} else {
+			kr.Begin = append(last[:len(last):len(last)], 0x00)
+		}
+	}
+	page.kr = kr
+	return
+}
@@ -0,0 +1,61 @@
+package opentick
+
+import (
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_Distinct(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table bar(sec int, interval int, time timestamp, px double, primary key(sec, interval, time))", nil)
+	assert.Equal(t, nil, err)
+	for _, v := range [][]interface{}{{1, 60, 0, 1}, {1, 60, 60, 2}, {1, 300, 0, 3}, {3, 60, 0, 4}, {3, 60, 60, 5}, {7, 86400, 0, 6}} {
+		_, err = Execute(db, "test", "insert into bar values(?, ?, ?, ?)", v)
+		assert.Equal(t, nil, err)
+	}
+	ret, err := Execute(db, "test", "select distinct sec from bar", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1] [3] [7]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select distinct interval, sec from bar", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[60 1] [300 1] [60 3] [86400 7]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select distinct sec from bar where sec > 1 limit 1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[3]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select distinct sec from bar limit -2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[7] [3]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select distinct sec, interval from bar where sec in (3, 1) and interval = 60", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 60] [3 60]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select distinct sec from bar where px > 4 allow filtering", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[3] [7]]", fmt.Sprint(ret))
+	// one round trip per transaction
+	pageSize := scanPageSize
+	scanPageSize = 1
+	for _, c := range [][2]string{
+		{"select distinct sec from bar", "[[1] [3] [7]]"},
+		{"select distinct interval, sec from bar", "[[60 1] [300 1] [60 3] [86400 7]]"},
+		{"select distinct sec from bar limit -2", "[[7] [3]]"},
+		{"select distinct sec from bar where px > 4 allow filtering", "[[3] [7]]"},
+		{"select distinct sec from bar where px < 2 or px > 5 limit -3 allow filtering", "[[7] [1]]"},
+	} {
+		ret, err = Execute(db, "test", c[0], nil)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, c[1], fmt.Sprint(ret))
+	}
+	scanPageSize = pageSize
+	_, err = Execute(db, "test", "select distinct interval from bar", nil)
+	assert.Equal(t, "DISTINCT only supports leading primary keys", err.Error())
+	_, err = Execute(db, "test", "select distinct sec, px from bar", nil)
+	assert.Equal(t, "DISTINCT only supports leading primary keys", err.Error())
+	_, err = Execute(db, "test", "select distinct * from bar", nil)
+	assert.Equal(t, "DISTINCT only supports leading primary keys", err.Error())
+	Execute(db, "", "drop table test.bar", nil)
+}
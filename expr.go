@@ -0,0 +1,535 @@
+package opentick
+
+import (
+	"errors"
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expression of select list, evaluated on the row of selectStmt.Cols
+// after adj, aggregation and conversion for reply
+type selectExpr struct {
+	Index   int         // of leaf in selectStmt.Cols, -1 if not leaf
+	Decimal bool        // leaf of decimal, which is string already
+	Value   interface{} // constant
+	Op      string
+	Args    []*selectExpr
+	Cast    *TableColDef
+	Whens   []selectWhen // of case, with else in Args
+}
+
+type selectWhen struct {
+	Cond [][]selectCompare // in disjunctive normal form
+	Then *selectExpr
+}
+
+type selectCompare struct {
+	Op  string
+	LHS *selectExpr
+	RHS *selectExpr
+}
+
+var scalarFuncs = map[string][2]int{
+	"abs":   {1, 1},
+	"round": {1, 2},
+	"log":   {1, 1},
+}
+
+// plain columns go first in items, then leaves of expressions;
+// exprs is nil if no expression selected
+func resolveSelectExprs(cols []AstSelectCol) (items []AstSelectCol, exprs []*selectExpr, nplain int, err error) {
+	exprs = make([]*selectExpr, len(cols))
+	hasExpr := false
+	for k, col := range cols {
+		if col.Expr == nil {
+			items = append(items, col)
+			exprs[k] = &selectExpr{Index: len(items) - 1}
+		} else {
+			hasExpr = true
+		}
+	}
+	nplain = len(items)
+	if !hasExpr {
+		exprs = nil
+		return
+	}
+	leaf := func(col AstSelectCol) *selectExpr {
+		items = append(items, col)
+		return &selectExpr{Index: len(items) - 1}
+	}
+	for k, col := range cols {
+		if col.Expr != nil {
+			exprs[k], err = compileExpr(col.Expr, leaf)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+type leafFunc func(col AstSelectCol) *selectExpr
+
+func compileExpr(ast *AstExpr, leaf leafFunc) (ret *selectExpr, err error) {
+	ret, err = compileTerm(ast.Left, leaf)
+	for _, r := range ast.Right {
+		if err != nil {
+			return
+		}
+		var rhs *selectExpr
+		op := "+"
+		if r.Minus != nil {
+			// "-1" lexed as negative number
+			rhs, err = compileTerm(&AstTerm{&AstFactor{Number: &r.Minus.AstNumber}, r.Right}, leaf)
+		} else {
+			op = *r.Op
+			rhs, err = compileTerm(r.Term, leaf)
+		}
+		ret = &selectExpr{Index: -1, Op: op, Args: []*selectExpr{ret, rhs}}
+	}
+	return
+}
+
+func compileTerm(ast *AstTerm, leaf leafFunc) (ret *selectExpr, err error) {
+	ret, err = compileFactor(ast.Left, leaf)
+	for _, r := range ast.Right {
+		if err != nil {
+			return
+		}
+		var rhs *selectExpr
+		rhs, err = compileFactor(r.Factor, leaf)
+		ret = &selectExpr{Index: -1, Op: *r.Op, Args: []*selectExpr{ret, rhs}}
+	}
+	return
+}
+
+func compileFactor(ast *AstFactor, leaf leafFunc) (ret *selectExpr, err error) {
+	ret = &selectExpr{Index: -1}
+	switch {
+	case ast.Number != nil:
+		ret.Value = (&AstValue{Number: ast.Number}).Value()
+	case ast.String != nil:
+		ret.Value = *ast.String
+	case ast.Boolean != nil:
+		ret.Value = bool(*ast.Boolean)
+	case ast.Null != nil:
+	case ast.Sub != nil:
+		ret, err = compileExpr(ast.Sub, leaf)
+	case ast.Cast != nil:
+		ret.Op = "cast"
+		ret.Cast, err = newTableColDef("CAST", string(*ast.Cast.Type), ast.Cast.Params)
+		if err != nil {
+			return
+		}
+		if ret.Cast.Type == Symbol {
+			err = errors.New("Cannot CAST to Symbol")
+			return
+		}
+		var arg *selectExpr
+		arg, err = compileExpr(ast.Cast.Expr, leaf)
+		ret.Args = []*selectExpr{arg}
+	case ast.Case != nil:
+		ret, err = compileCase(ast.Case, leaf)
+	case ast.Call != nil:
+		ret.Op = strings.ToLower(*ast.Call.Name)
+		n, ok := scalarFuncs[ret.Op]
+		if !ok {
+			err = errors.New("Unknown function " + *ast.Call.Name)
+			return
+		}
+		if len(ast.Call.Args) < n[0] || len(ast.Call.Args) > n[1] {
+			err = errors.New("Wrong number of arguments for " + *ast.Call.Name)
+			return
+		}
+		ret.Args = make([]*selectExpr, len(ast.Call.Args))
+		for i := range ast.Call.Args {
+			if ret.Args[i], err = compileExpr(&ast.Call.Args[i], leaf); err != nil {
+				return
+			}
+		}
+	case ast.Ohlcv != nil:
+		err = errors.New("ohlcv cannot be used in expression")
+	case ast.Agg != nil:
+		ret = leaf(AstSelectCol{Agg: ast.Agg})
+	case ast.Func != nil:
+		ret = leaf(AstSelectCol{Func: ast.Func})
+	default:
+		col := AstSelectCol{Name: ast.Col.A}
+		if ast.Col.B != nil {
+			col = AstSelectCol{Table: ast.Col.A, Name: ast.Col.B}
+		}
+		ret = leaf(col)
+	}
+	if err == nil && ast.Neg != nil {
+		ret = &selectExpr{Index: -1, Op: "neg", Args: []*selectExpr{ret}}
+	}
+	return
+}
+
+func compileCase(ast *AstCase, leaf leafFunc) (ret *selectExpr, err error) {
+	ret = &selectExpr{Index: -1, Op: "case"}
+	for _, w := range ast.When {
+		var when selectWhen
+		if when.Cond, err = compileWhenCond(w.Cond, leaf); err != nil {
+			return
+		}
+		if when.Then, err = compileExpr(w.Then, leaf); err != nil {
+			return
+		}
+		ret.Whens = append(ret.Whens, when)
+	}
+	if ast.Else != nil {
+		var e *selectExpr
+		if e, err = compileExpr(ast.Else, leaf); err != nil {
+			return
+		}
+		ret.Args = []*selectExpr{e}
+	}
+	return
+}
+
+func compileWhenCond(ast *AstWhenCond, leaf leafFunc) (terms [][]selectCompare, err error) {
+	var and []selectCompare
+	for _, c := range ast.And {
+		cmp := selectCompare{}
+		if cmp.LHS, err = compileExpr(c.LHS, leaf); err != nil {
+			return
+		}
+		if c.IsNull != nil {
+			cmp.Op = "is null"
+			if *c.IsNull != "NULL" {
+				cmp.Op = "is not null"
+			}
+		} else {
+			cmp.Op = *c.Op
+			if cmp.RHS, err = compileExpr(c.RHS, leaf); err != nil {
+				return
+			}
+		}
+		and = append(and, cmp)
+	}
+	terms = [][]selectCompare{and}
+	for i := range ast.Or {
+		var or [][]selectCompare
+		if or, err = compileWhenCond(&ast.Or[i], leaf); err != nil {
+			return
+		}
+		terms = append(terms, or...)
+	}
+	return
+}
+
+func (self *selectExpr) walk(fn func(*selectExpr)) {
+	fn(self)
+	for _, arg := range self.Args {
+		arg.walk(fn)
+	}
+	for _, w := range self.Whens {
+		for _, and := range w.Cond {
+			for _, c := range and {
+				c.LHS.walk(fn)
+				if c.RHS != nil {
+					c.RHS.walk(fn)
+				}
+			}
+		}
+		w.Then.walk(fn)
+	}
+}
+
+func (self *selectStmt) setExprs(exprs []*selectExpr) {
+	self.Exprs = exprs
+	for _, e := range exprs {
+		e.walk(func(e *selectExpr) {
+			if e.Index < 0 {
+				return
+			}
+			col := self.Cols[e.Index]
+			if col == nil && self.Join != nil {
+				col = self.Join.Cols[e.Index]
+			}
+			count := self.Aggs != nil && self.Aggs[e.Index] != nil && self.Aggs[e.Index].Name == "count"
+			e.Decimal = col != nil && col.Type == Decimal && !count
+		})
+	}
+}
+
+func evalExprs(exprs []*selectExpr, res [][]interface{}) (out [][]interface{}, err error) {
+	out = make([][]interface{}, len(res))
+	for i, row := range res {
+		out[i] = make([]interface{}, len(exprs))
+		for k, e := range exprs {
+			if out[i][k], err = e.eval(row); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+func (self *selectExpr) eval(row []interface{}) (ret interface{}, err error) {
+	if self.Index >= 0 {
+		ret = row[self.Index]
+		if s, ok := ret.(string); ok && self.Decimal {
+			ret, _ = strconv.ParseFloat(s, 64)
+		}
+		return
+	}
+	if self.Op == "" {
+		return self.Value, nil
+	}
+	if self.Op == "case" {
+		return self.evalCase(row)
+	}
+	args := make([]interface{}, len(self.Args))
+	for i, arg := range self.Args {
+		if args[i], err = arg.eval(row); err != nil {
+			return
+		}
+		if args[i] == nil {
+			return
+		}
+	}
+	switch self.Op {
+	case "cast":
+		return castValue(args[0], self.Cast)
+	case "neg":
+		return arith("-", int64(0), args[0])
+	case "abs":
+		if v, ok := getInt(args[0]); ok {
+			if v < 0 {
+				v = -v
+			}
+			return v, nil
+		}
+		v, err1 := getNumber(args[0], "ABS")
+		return math.Abs(v), err1
+	case "round":
+		if v, ok := getInt(args[0]); ok && len(args) == 1 {
+			return v, nil
+		}
+		v, err1 := getNumber(args[0], "ROUND")
+		if err1 != nil || len(args) == 1 {
+			return math.Round(v), err1
+		}
+		n, ok := getInt(args[1])
+		if !ok {
+			return nil, errors.New("ROUND expects integer digits, got " + fmt.Sprint(args[1]))
+		}
+		p := math.Pow(10, float64(n))
+		return math.Round(v*p) / p, nil
+	case "log":
+		v, err1 := getNumber(args[0], "LOG")
+		if err1 != nil || v <= 0 {
+			return nil, err1
+		}
+		return math.Log(v), nil
+	}
+	return arith(self.Op, args[0], args[1])
+}
+
+func (self *selectExpr) evalCase(row []interface{}) (ret interface{}, err error) {
+	for _, w := range self.Whens {
+		for _, and := range w.Cond {
+			matched := true
+			for _, c := range and {
+				if matched, err = c.match(row); err != nil || !matched {
+					break
+				}
+			}
+			if err != nil {
+				return
+			}
+			if matched {
+				return w.Then.eval(row)
+			}
+		}
+	}
+	if self.Args != nil {
+		return self.Args[0].eval(row)
+	}
+	return
+}
+
+func (self *selectCompare) match(row []interface{}) (ok bool, err error) {
+	a, err := self.LHS.eval(row)
+	if err != nil {
+		return
+	}
+	switch self.Op {
+	case "is null":
+		return a == nil, nil
+	case "is not null":
+		return a != nil, nil
+	}
+	b, err := self.RHS.eval(row)
+	if err != nil || a == nil || b == nil {
+		return
+	}
+	c := compareValue(a, b)
+	switch self.Op {
+	case "=":
+		return c == 0, nil
+	case "<>", "!=":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	}
+	return
+}
+
+func getNumber(v interface{}, op string) (ret float64, err error) {
+	ret, ok := getFloat(v)
+	if !ok {
+		err = errors.New("Invalid operand (" + fmt.Sprint(v) + ") for " + op)
+	}
+	return
+}
+
+// "/" is always float division, nil if divided by zero
+func arith(op string, a interface{}, b interface{}) (ret interface{}, err error) {
+	if a1, ok := getInt(a); ok && op != "/" {
+		if b1, ok := getInt(b); ok {
+			switch op {
+			case "+":
+				return a1 + b1, nil
+			case "-":
+				return a1 - b1, nil
+			case "*":
+				return a1 * b1, nil
+			case "%":
+				if b1 == 0 {
+					return
+				}
+				return a1 % b1, nil
+			}
+		}
+	}
+	a1, err := getNumber(a, op)
+	if err != nil {
+		return
+	}
+	b1, err := getNumber(b, op)
+	if err != nil {
+		return
+	}
+	switch op {
+	case "+":
+		return a1 + b1, nil
+	case "-":
+		return a1 - b1, nil
+	case "*":
+		return a1 * b1, nil
+	case "/":
+		if b1 == 0 {
+			return
+		}
+		return a1 / b1, nil
+	case "%":
+		if b1 == 0 {
+			return
+		}
+		return math.Mod(a1, b1), nil
+	}
+	return
+}
+
+func castValue(v interface{}, col *TableColDef) (ret interface{}, err error) {
+	invalid := func() error {
+		return errors.New("Cannot CAST (" + fmt.Sprint(v) + ") to " + col.Type.Name())
+	}
+	if b, ok := v.(bool); ok {
+		switch col.Type {
+		case Boolean:
+			return b, nil
+		case Text:
+			return strconv.FormatBool(b), nil
+		}
+		v = int64(0)
+		if b {
+			v = int64(1)
+		}
+	}
+	switch col.Type {
+	case TinyInt, SmallInt, Int, BigInt, Timestamp:
+		if s, ok := v.(string); ok && col.Type != Timestamp {
+			if i, err1 := strconv.ParseInt(s, 10, 64); err1 == nil {
+				v = i
+			} else if f, err1 := strconv.ParseFloat(s, 64); err1 == nil {
+				v = f
+			} else {
+				return nil, invalid()
+			}
+		}
+		if f, ok := getFloat(v); ok {
+			if _, ok := getInt(v); !ok {
+				if col.Type == Timestamp {
+					// seconds
+					return nsToTimestamp(int64(math.Round(f * 1e9))), nil
+				}
+				v = int64(f)
+			}
+		}
+		ret, err = validateValue(col, v, true)
+		if err != nil {
+			err = invalid()
+		}
+	case Double, Float, Decimal:
+		if s, ok := v.(string); ok && col.Type != Decimal {
+			f, err1 := strconv.ParseFloat(s, 64)
+			if err1 != nil {
+				return nil, invalid()
+			}
+			v = f
+		} else if f, ok := v.(float32); ok {
+			v = float64(f)
+		}
+		ret, err = validateValue(col, v, false)
+		if err != nil {
+			return nil, invalid()
+		}
+		if col.Type == Decimal {
+			ret = formatDecimal(ret.(int64), col.Scale)
+		}
+	case Boolean:
+		if s, ok := v.(string); ok {
+			if ret, err = strconv.ParseBool(s); err != nil {
+				err = invalid()
+			}
+		} else if f, ok := getFloat(v); ok {
+			ret = f != 0
+		} else {
+			err = invalid()
+		}
+	case Text:
+		switch v1 := v.(type) {
+		case []byte:
+			ret = string(v1)
+		case tuple.Tuple:
+			ns, _ := getTimestamp(v1)
+			ret = time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+		default:
+			ret = fmt.Sprint(v)
+		}
+	case Blob:
+		switch v1 := v.(type) {
+		case []byte:
+			ret = v1
+		case string:
+			ret = []byte(v1)
+		default:
+			err = invalid()
+		}
+	}
+	return
+}
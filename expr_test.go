@@ -0,0 +1,56 @@
+package opentick
+
+import (
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func evalSelectExprs(sql string) (res [][]interface{}, err error) {
+	ast, err := Parse(sql)
+	if err != nil {
+		return
+	}
+	items, exprs, _, err := resolveSelectExprs(ast.Select.Selected.Cols)
+	if err != nil {
+		return
+	}
+	values := map[string]interface{}{"px": 2.25, "qty": int64(7), "d": "1.25", "tm": tuple.Tuple{int64(1767364200), int64(5)}, "n": nil}
+	stmt := &selectStmt{Cols: make([]*TableColDef, len(items))}
+	row := make([]interface{}, len(items))
+	for i, item := range items {
+		stmt.Cols[i] = NewTableColDef(*item.Name, Double)
+		if *item.Name == "d" {
+			stmt.Cols[i].Type = Decimal
+		}
+		row[i] = values[*item.Name]
+	}
+	stmt.setExprs(exprs)
+	return evalExprs(stmt.Exprs, [][]interface{}{row})
+}
+
+func Test_SelectExpr(t *testing.T) {
+	res, err := evalSelectExprs("select px * qty as notional, (px + qty) / 2 AS mid, px-1*2, qty, d * 2, n + 1 from t")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[15.75 4.625 0.25 7 2.5 <nil>]]", fmt.Sprint(res))
+	res, err = evalSelectExprs("select -px, abs(qty - 10), round(px, 1), round(px), case when log(qty) > 1.9 then true end, qty % 3, qty / 0 from t")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[-2.25 3 2.3 2 true 1 <nil>]]", fmt.Sprint(res))
+	res, err = evalSelectExprs("select cast(qty as double), cast(px as decimal(10,1)), cast(px as int), cast(tm as text), cast('12' as int), cast(1 as boolean) from t")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[7 2.3 2 2026-01-02T14:30:00.000000005Z 12 true]]", fmt.Sprint(res))
+	res, err = evalSelectExprs("select case when px > 3 or n is not null then 'big' when px <> 0 and qty != 1 then 'mid' else 'small' end, case when qty = 0 then 1 end from t")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[mid <nil>]]", fmt.Sprint(res))
+	_, err = evalSelectExprs("select cast('x' as int) from t")
+	assert.Equal(t, "Cannot CAST (x) to Int", err.Error())
+	_, err = evalSelectExprs("select px + 'a' from t")
+	assert.Equal(t, "Invalid operand (a) for +", err.Error())
+	_, err = evalSelectExprs("select foo(px) from t")
+	assert.Equal(t, "Unknown function foo", err.Error())
+	_, err = evalSelectExprs("select round(px, 1, 2) from t")
+	assert.Equal(t, "Wrong number of arguments for round", err.Error())
+	_, err = evalSelectExprs("select cast(px as symbol) from t")
+	assert.Equal(t, "Cannot CAST to Symbol", err.Error())
+}
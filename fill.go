@@ -0,0 +1,240 @@
+package opentick
+
+import (
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"strings"
+)
+
+const maxFillBuckets = 1000000
+
+// FILL(previous|null|linear|<value>) of time bucketed select
+type fillOption struct {
+	Mode   string
+	Values []interface{} // of value mode, per column
+}
+
+// buckets between where time bounds and last rows before the bounds, built per execution
+type fillGrid struct {
+	Buckets []int64 // ascending
+	Prev    [][2]tuple.Tuple
+}
+
+func resolveFill(stmt *selectStmt, ast *AstFill) (err error) {
+	if stmt.Bucket == nil {
+		return errors.New("FILL requires time bucket")
+	}
+	if stmt.Bucket.Col != stmt.Schema.Keys[len(stmt.Schema.Keys)-1] {
+		return errors.New("FILL requires bucket on the last primary key")
+	}
+	bounded := stmt.Where != nil
+	for _, branch := range stmt.Where {
+		n := len(branch.Conds)
+		if n != len(stmt.Schema.Keys) || branch.Conds[n-1].Start[0] == nil || branch.Conds[n-1].End[0] == nil {
+			bounded = false
+		}
+	}
+	if !bounded {
+		return errors.New("FILL requires both lower and upper bounds of " + stmt.Bucket.Col.Name + " in WHERE")
+	}
+	fill := &fillOption{}
+	if ast.Mode != nil {
+		fill.Mode = strings.ToLower(*ast.Mode)
+	} else {
+		fill.Mode = "value"
+		fill.Values = make([]interface{}, len(stmt.Cols))
+		var v interface{}
+		if ast.Value.Int != nil {
+			v = *ast.Value.Int
+		} else {
+			v = *ast.Value.Float
+		}
+		for j, col := range stmt.Cols {
+			if stmt.Aggs[j] == nil || stmt.Aggs[j].Name == "count" {
+				continue
+			}
+			switch col.Type {
+			case TinyInt, SmallInt, Int, BigInt, Double, Float:
+				fill.Values[j] = v
+			case Decimal:
+				// scaled as avg
+				f, _ := getFloat(v)
+				fill.Values[j] = f * float64(pow10[col.Scale])
+			default:
+				return errors.New("FILL value not allowed on column " + col.Name + " of " + col.Type.Name())
+			}
+		}
+	}
+	stmt.Fill = fill
+	return
+}
+
+// bucket grid of the time bounds, which must be the same in every branch of where
+func (self *fillOption) grid(stmt *selectStmt, ranges []whereRange) (ret *fillGrid, err error) {
+	var a, b int64
+	var inclusive bool
+	for i := range ranges {
+		c := &ranges[i].Conds[len(ranges[i].Conds)-1]
+		a1, ok1 := getTimestamp(c.Start[0])
+		b1, ok2 := getTimestamp(c.End[0])
+		if !ok1 || !ok2 {
+			err = errors.New("Internal errror: invalid bounds of " + stmt.Bucket.Col.Name)
+			return
+		}
+		if c.End[1] == nil {
+			b1--
+		}
+		if i > 0 && (a1 != a || b1 != b || (c.Start[1] != nil) != inclusive) {
+			err = errors.New("FILL requires the same bounds of " + stmt.Bucket.Col.Name + " in every branch of WHERE")
+			return
+		}
+		a, b, inclusive = a1, b1, c.Start[1] != nil
+	}
+	ret = &fillGrid{}
+	for t := a; t <= b; {
+		bucket, ok := stmt.Bucket.floor(t)
+		if !ok {
+			// sessions are in minutes
+			t = (floorDiv(t, 60e9) + 1) * 60e9
+			continue
+		}
+		if len(ret.Buckets) >= maxFillBuckets {
+			err = errors.New("Too many buckets to FILL")
+			return
+		}
+		ret.Buckets = append(ret.Buckets, bucket)
+		t = bucket + stmt.Bucket.Interval
+	}
+	return
+}
+
+// last record before time bounds of every range
+func readPrevious(tr fdb.Transaction, schema *TableSchema, ranges []whereRange) (recs [][2]tuple.Tuple, err error) {
+	for i := range ranges {
+		r := &ranges[i]
+		n := len(r.Conds) - 1
+		sub := schema.Dir.Sub()
+		for _, c := range r.Conds[:n] {
+			sub = sub.Sub(c.Equal)
+		}
+		kr := fdb.KeyRange{Begin: fdb.Key(append(sub.Bytes(), 0x00))}
+		k := sub.Sub(r.Conds[n].Start[0])
+		if r.Conds[n].Start[1] == nil {
+			_, kr.End = k.FDBRangeKeys()
+		} else {
+			kr.End = k
+		}
+		res, err1 := readRange(tr, schema, &whereRange{Range: kr, Filters: r.Filters}, 1, true)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		for _, rec := range res {
+			recs = append(recs, rec.rec)
+		}
+	}
+	return
+}
+
+type fillSeries struct {
+	template *aggGroup
+	rows     map[int64]*aggGroup
+	prev     *aggGroup // last record before time bounds
+}
+
+// one row per bucket of grid for every group, count is 0 for missing buckets
+func (self *fillGrid) apply(stmt *selectStmt, groups []*aggGroup) (ret []*aggGroup) {
+	var series []*fillSeries
+	index := make(map[string]*fillSeries)
+	get := func(g *aggGroup) *fillSeries {
+		k := string(g.keys.Pack())
+		s, ok := index[k]
+		if !ok {
+			s = &fillSeries{template: g, rows: make(map[int64]*aggGroup)}
+			index[k] = s
+			series = append(series, s)
+		}
+		return s
+	}
+	for _, g := range groups {
+		get(g).rows[g.bucket] = g
+	}
+	for _, rec := range self.Prev {
+		keys := make(tuple.Tuple, len(stmt.GroupBy))
+		for i, col := range stmt.GroupBy {
+			keys[i] = getColValue(col, rec)
+		}
+		g := newAggGroup(stmt, keys, getColValue(stmt.Bucket.Col, rec), rec)
+		g.add(stmt, rec)
+		g.result(stmt)
+		if s := get(g); s.prev == nil || g.bucket > s.prev.bucket {
+			s.prev = g
+		}
+	}
+	fill := stmt.Fill
+	for _, s := range series {
+		rows := make([]*aggGroup, len(self.Buckets))
+		last := s.prev
+		for i, b := range self.Buckets {
+			if g, ok := s.rows[b]; ok {
+				rows[i] = g
+				last = g
+				continue
+			}
+			g := &aggGroup{row: make([]interface{}, len(stmt.Cols)), keys: s.template.keys, bucket: b}
+			for j, col := range stmt.Cols {
+				a := stmt.Aggs[j]
+				if a == nil {
+					if col == stmt.Bucket.Col {
+						g.row[j] = nsToTimestamp(b)
+					} else {
+						g.row[j] = s.template.row[j]
+					}
+					continue
+				}
+				if a.Name == "count" {
+					g.row[j] = int64(0)
+					continue
+				}
+				switch fill.Mode {
+				case "previous":
+					if last != nil {
+						g.row[j] = last.row[j]
+					}
+				case "linear":
+					if last != nil {
+						g.row[j] = self.interpolate(s, last, b, i, j)
+					}
+				case "value":
+					g.row[j] = fill.Values[j]
+				}
+			}
+			rows[i] = g
+		}
+		if stmt.Reverse {
+			for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+				rows[i], rows[j] = rows[j], rows[i]
+			}
+		}
+		ret = append(ret, rows...)
+	}
+	return
+}
+
+// linear between last known row and next known row after bucket i, nil if no next one
+func (self *fillGrid) interpolate(s *fillSeries, last *aggGroup, b int64, i int, j int) interface{} {
+	for _, b2 := range self.Buckets[i+1:] {
+		next, ok := s.rows[b2]
+		if !ok {
+			continue
+		}
+		v1, ok1 := getFloat(last.row[j])
+		v2, ok2 := getFloat(next.row[j])
+		if !ok1 || !ok2 {
+			return nil
+		}
+		return v1 + (v2-v1)*float64(b-last.bucket)/float64(next.bucket-last.bucket)
+	}
+	return nil
+}
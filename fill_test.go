@@ -0,0 +1,72 @@
+package opentick
+
+import (
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_FillGrid(t *testing.T) {
+	sec := &TableColDef{Name: "sec", Type: Int, IsKey: true}
+	tm := &TableColDef{Name: "time", Type: Timestamp, IsKey: true, Pos: 1}
+	px := &TableColDef{Name: "px", Type: Double, Pos: 0}
+	stmt := &selectStmt{
+		Schema: &TableSchema{Keys: []*TableColDef{sec, tm}},
+		Cols:   []*TableColDef{tm, px, nil},
+		Aggs:   []*aggFunc{nil, &aggFunc{Name: "last"}, &aggFunc{Name: "count"}},
+		Bucket: &timeBucket{Col: tm, Interval: 60e9},
+	}
+	ranges := []whereRange{{Conds: []condition{{Equal: 1}, {Start: [2]interface{}{tuple.Tuple{0, 0}, true}, End: [2]interface{}{tuple.Tuple{300, 0}}}}}}
+	stmt.Fill = &fillOption{Mode: "previous"}
+	grid, err := stmt.Fill.grid(stmt, ranges)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int64{0, 60e9, 120e9, 180e9, 240e9}, grid.Buckets)
+	rec := func(sec int64, px float64) [2]tuple.Tuple {
+		return [2]tuple.Tuple{{int64(1), tuple.Tuple{sec, int64(0)}}, {px}}
+	}
+	recs := [][2]tuple.Tuple{rec(70, 10), rec(190, 13)}
+	assert.Equal(t, "[[[0 0] <nil> 0] [[60 0] 10 1] [[120 0] 10 0] [[180 0] 13 1] [[240 0] 13 0]]", fmt.Sprint(aggregate(stmt, recs, grid)))
+	grid.Prev = [][2]tuple.Tuple{rec(-5, 9)}
+	assert.Equal(t, "[[[0 0] 9 0] [[60 0] 10 1] [[120 0] 10 0] [[180 0] 13 1] [[240 0] 13 0]]", fmt.Sprint(aggregate(stmt, recs, grid)))
+	stmt.Fill.Mode = "linear"
+	assert.Equal(t, "[[[0 0] 9.076923076923077 0] [[60 0] 10 1] [[120 0] 11.5 0] [[180 0] 13 1] [[240 0] <nil> 0]]", fmt.Sprint(aggregate(stmt, recs, grid)))
+	stmt.Fill = &fillOption{Mode: "value", Values: []interface{}{nil, 0.0, nil}}
+	stmt.Limit = 2
+	stmt.Reverse = true
+	assert.Equal(t, "[[[240 0] 0 0] [[180 0] 13 1]]", fmt.Sprint(aggregate(stmt, [][2]tuple.Tuple{rec(190, 13), rec(70, 10)}, grid)))
+	ranges = append(ranges, whereRange{Conds: []condition{{Equal: 2}, {Start: [2]interface{}{tuple.Tuple{60, 0}, true}, End: [2]interface{}{tuple.Tuple{300, 0}}}}})
+	_, err = stmt.Fill.grid(stmt, ranges)
+	assert.Equal(t, "FILL requires the same bounds of time in every branch of WHERE", err.Error())
+}
+
+func Test_Fill(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for _, v := range [][]interface{}{{1, 0, 9, 1}, {1, 130, 10, 2}, {1, 250, 12, 3}, {2, 130, 5, 4}} {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?, ?)", v)
+		assert.Equal(t, nil, err)
+	}
+	ret, err := Execute(db, "test", "select time, last(px), count(*) from trade where sec=1 and time>=60 and time<300 group by bucket(time, '1m') fill(previous)", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[60 0] 9 0] [[120 0] 10 1] [[180 0] 10 0] [[240 0] 12 1]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, last(px) from trade where sec=1 and time>=60 and time<300 group by bucket(time, '1m') fill(linear)", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[60 0] 9.5] [[120 0] 10] [[180 0] 11] [[240 0] 12]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, time, sum(qty) from trade where sec in (1, 2) and time>=120 and time<240 group by sec, bucket(time, '1m') fill(0)", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 [120 0] 2] [1 [180 0] 0] [2 [120 0] 4] [2 [180 0] 0]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, sum(qty) from trade where sec=1 and time>=60 and time<300 group by bucket(time, '1m') fill(null) limit -1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[240 0] 3]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select time, sum(qty) from trade where sec=1 and time>=60 group by bucket(time, '1m') fill(null)", nil)
+	assert.Equal(t, "FILL requires both lower and upper bounds of time in WHERE", err.Error())
+	_, err = Execute(db, "test", "select sum(qty) from trade where sec=1 fill(null)", nil)
+	assert.Equal(t, "FILL requires time bucket", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
@@ -0,0 +1,68 @@
+package opentick
+
+import (
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// LATEST BY reads the last row of every key prefix restricted in where with reverse limit-1 range reads
+func resolveLatestBy(stmt *selectStmt, ast *AstSelect, items []AstSelectCol) (err error) {
+	schema := stmt.Schema
+	n := len(ast.LatestBy)
+	if n >= len(schema.Keys) {
+		return errors.New("LATEST BY cannot be used with all primary keys")
+	}
+	for i, name := range ast.LatestBy {
+		if _, ok := schema.NameMap[name]; !ok {
+			return errors.New("Undefined column name " + name)
+		}
+		if schema.Keys[i].Name != name {
+			return errors.New("Invalid column " + name + " in LATEST BY, leading primary keys expected")
+		}
+	}
+	if ast.Join != nil {
+		return errors.New("LATEST BY cannot be used with ASOF JOIN")
+	}
+	if ast.GroupBy != nil {
+		return errors.New("LATEST BY cannot be used with GROUP BY")
+	}
+	if ast.OrderBy != nil || stmt.Reverse {
+		return errors.New("LATEST BY cannot be used with ORDER BY or negative LIMIT")
+	}
+	for _, col := range items {
+		if col.Agg != nil || col.Ohlcv != nil {
+			return errors.New("LATEST BY cannot be used with aggregate")
+		}
+	}
+	for i := 0; i < n; i++ {
+		ok := stmt.Where != nil
+		for _, branch := range stmt.Where {
+			if i >= len(branch.Conds) || branch.Conds[i].Equal == nil {
+				ok = false
+			}
+		}
+		if !ok {
+			return errors.New("LATEST BY requires " + schema.Keys[i].Name + " to be restricted by '=' or IN")
+		}
+	}
+	stmt.Latest = n
+	return
+}
+
+// keep the last record of every prefix of n keys, recs are in key order
+func latestRecords(recs [][2]tuple.Tuple, n int, limit int) (ret [][2]tuple.Tuple) {
+	var last string
+	for _, rec := range recs {
+		prefix := string(tuple.Tuple(rec[0][:n]).Pack())
+		if len(ret) > 0 && prefix == last {
+			ret[len(ret)-1] = rec
+			continue
+		}
+		if limit > 0 && len(ret) >= limit {
+			break
+		}
+		ret = append(ret, rec)
+		last = prefix
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package opentick
+
+import (
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_LatestRecords(t *testing.T) {
+	rec := func(sec int64, tm int64) [2]tuple.Tuple {
+		return [2]tuple.Tuple{{sec, tm}, {}}
+	}
+	recs := [][2]tuple.Tuple{rec(1, 5), rec(1, 9), rec(2, 3), rec(3, 1), rec(3, 2)}
+	assert.Equal(t, [][2]tuple.Tuple{rec(1, 9), rec(2, 3), rec(3, 2)}, latestRecords(recs, 1, 0))
+	assert.Equal(t, [][2]tuple.Tuple{rec(1, 9), rec(2, 3)}, latestRecords(recs, 1, 2))
+	assert.Equal(t, [][2]tuple.Tuple(nil), latestRecords(nil, 1, 0))
+}
+
+func Test_LatestBy(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "insert into _adj_ values(1, 300, 0.5, 2)", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "create table quote(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for _, v := range [][]interface{}{{1, 100, 10, 1}, {1, 200, 12, 2}, {1, 400, 6, 3}, {2, 100, 5, 4}, {3, 500, 7, 5}} {
+		_, err = Execute(db, "test", "insert into quote values(?, ?, ?, ?)", v)
+		assert.Equal(t, nil, err)
+	}
+	ret, err := Execute(db, "test", "select sec, time, px from quote where sec in (3, 1, 2, 4) latest by sec", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 [400 0] 6] [2 [100 0] 5] [3 [500 0] 7]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, adj(px), adj(qty) from quote where sec in (1, 2) and time < 300 latest by sec", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 6 4] [2 5 4]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, px from quote where sec in (?, ?) latest by sec limit 1", []interface{}{2, 3})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[2 5]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select sec, px from quote latest by sec", nil)
+	assert.Equal(t, "LATEST BY requires sec to be restricted by '=' or IN", err.Error())
+	_, err = Execute(db, "test", "select sec, px from quote where sec=1 latest by time", nil)
+	assert.Equal(t, "Invalid column time in LATEST BY, leading primary keys expected", err.Error())
+	_, err = Execute(db, "test", "select max(px) from quote where sec=1 latest by sec", nil)
+	assert.Equal(t, "LATEST BY cannot be used with aggregate", err.Error())
+	Execute(db, "", "drop table test.quote", nil)
+}
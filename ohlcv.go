@@ -0,0 +1,180 @@
+package opentick
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// trading session in wall clock of Loc, minutes from midnight, overnight if Start >= End
+type tradingSession struct {
+	Start int
+	End   int
+	Loc   *time.Location
+}
+
+func parseSession(str string, tz string) (ret *tradingSession, err error) {
+	invalid := errors.New("Invalid session '" + str + "', HH:MM-HH:MM expected")
+	parts := strings.Split(strings.TrimSpace(str), "-")
+	if len(parts) != 2 {
+		err = invalid
+		return
+	}
+	var mins [2]int
+	for i, p := range parts {
+		tm, err1 := time.Parse("15:04", strings.TrimSpace(p))
+		if err1 != nil {
+			err = invalid
+			return
+		}
+		mins[i] = tm.Hour()*60 + tm.Minute()
+	}
+	loc := time.UTC
+	if tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			err = errors.New("Unknown time zone '" + tz + "'")
+			return
+		}
+	}
+	ret = &tradingSession{mins[0], mins[1], loc}
+	return
+}
+
+// start of the session which ns falls in, false if out of session
+func (self *tradingSession) start(ns int64) (ret int64, ok bool) {
+	t := time.Unix(0, ns).In(self.Loc)
+	y, m, d := t.Date()
+	tod := int64(t.Hour()*60+t.Minute())*60e9 + int64(t.Second())*1e9 + int64(t.Nanosecond())
+	start := int64(self.Start) * 60e9
+	end := int64(self.End) * 60e9
+	if self.Start < self.End {
+		if tod < start || tod >= end {
+			return
+		}
+	} else if tod < start {
+		if tod >= end {
+			return
+		}
+		// overnight session started yesterday
+		d--
+	}
+	return time.Date(y, m, d, 0, self.Start, 0, 0, self.Loc).UnixNano(), true
+}
+
+// ohlcv(px, qty, interval[, session[, tz]]) is rewritten to bucketed aggregates grouped by the
+// keys but the last one, output as keys..., time, open, high, low, close, volume, vwap, count
+func resolveOhlcv(stmt *selectStmt, ast *AstSelect, items []AstSelectCol) (err error) {
+	schema := stmt.Schema
+	if ast.GroupBy != nil {
+		return errors.New("ohlcv cannot be used with GROUP BY")
+	}
+	if ast.Join != nil {
+		return errors.New("ohlcv cannot be used with ASOF JOIN")
+	}
+	if len(items) != len(ast.Selected.Cols) {
+		return errors.New("ohlcv cannot be used with expression")
+	}
+	nkeys := len(schema.Keys)
+	timeCol := schema.Keys[nkeys-1]
+	if timeCol.Type != Timestamp {
+		return errors.New("The last primary key " + timeCol.Name + " must be timestamp for ohlcv")
+	}
+	var ohlcv *AstOhlcv
+	for _, col := range items {
+		if col.Ohlcv != nil {
+			if ohlcv != nil {
+				return errors.New("Only one ohlcv allowed")
+			}
+			ohlcv = col.Ohlcv
+			continue
+		}
+		if ohlcv != nil || col.Name == nil || col.Table != nil && *col.Table != schema.TblName {
+			return errors.New("Only leading primary keys can be selected before ohlcv")
+		}
+		col2, ok := schema.NameMap[*col.Name]
+		if !ok {
+			return errors.New("Undefined column name " + *col.Name)
+		}
+		if !col2.IsKey || int(col2.Pos) != len(stmt.Cols) || int(col2.Pos) >= nkeys-1 {
+			return errors.New("Only leading primary keys can be selected before ohlcv")
+		}
+		stmt.Cols = append(stmt.Cols, col2)
+	}
+	interval, err := parseInterval(*ohlcv.Interval)
+	if err != nil {
+		return
+	}
+	if interval <= 0 {
+		return errors.New("Invalid interval '" + *ohlcv.Interval + "'")
+	}
+	var session *tradingSession
+	if ohlcv.Session != nil {
+		tz := ""
+		if ohlcv.TimeZone != nil {
+			tz = *ohlcv.TimeZone
+		}
+		session, err = parseSession(*ohlcv.Session, tz)
+		if err != nil {
+			return
+		}
+	}
+	px, pxFunc, err := resolveOhlcvArg(schema, ohlcv.Px)
+	if err != nil {
+		return
+	}
+	qty, qtyFunc, err := resolveOhlcvArg(schema, ohlcv.Qty)
+	if err != nil {
+		return
+	}
+	if px == qty {
+		return errors.New("Duplicate column name " + px.Name + " in ohlcv")
+	}
+	n := len(stmt.Cols)
+	stmt.Funcs = make([]*selectFunc, n)
+	stmt.Aggs = make([]*aggFunc, n)
+	stmt.Cols = append(stmt.Cols, timeCol, px, px, px, px, qty, px, nil)
+	stmt.Funcs = append(stmt.Funcs, nil, pxFunc, pxFunc, pxFunc, pxFunc, qtyFunc, pxFunc, nil)
+	for _, name := range []string{"", "first", "max", "min", "last", "sum", "vwap", "count"} {
+		var a *aggFunc
+		if name != "" {
+			a = &aggFunc{Name: name}
+		}
+		stmt.Aggs = append(stmt.Aggs, a)
+	}
+	stmt.Aggs[n+6].Weight = qty
+	stmt.GroupBy = schema.Keys[:nkeys-1]
+	stmt.Bucket = &timeBucket{Col: timeCol, Interval: interval, Session: session}
+	return getAdjTuples(stmt)
+}
+
+func resolveOhlcvArg(schema *TableSchema, arg *AstOhlcvArg) (col *TableColDef, fn *selectFunc, err error) {
+	name := arg.Col
+	if arg.Func != nil {
+		name = arg.Func.Col
+	}
+	col, ok := schema.NameMap[*name]
+	if !ok {
+		err = errors.New("Undefined column name " + *name)
+		return
+	}
+	switch col.Type {
+	case TinyInt, SmallInt, Int, BigInt, Double, Float, Decimal:
+	default:
+		err = errors.New("Invalid column " + col.Name + " of " + col.Type.Name() + " for ohlcv, number expected")
+		return
+	}
+	if col.IsKey {
+		err = errors.New("Invalid column " + col.Name + " for ohlcv, primary key not allowed")
+		return
+	}
+	if arg.Func != nil {
+		fnName := strings.ToLower(*arg.Func.Name)
+		if !strings.HasPrefix(fnName, "adj") {
+			err = errors.New("Only adj can be applied to column " + col.Name + " in ohlcv")
+			return
+		}
+		fn, err = resolveSelectFunc(col, arg.Func)
+	}
+	return
+}
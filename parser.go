@@ -1,28 +1,46 @@
 package opentick
 
 import (
+	"errors"
 	"github.com/alecthomas/participle"
 	"github.com/alecthomas/participle/lexer"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	sqlLexer = lexer.Must(lexer.Regexp(`(\s+)` +
-		`|(?P<Keyword>(?i)\b(TIMESTAMP|DATABASE|BOOLEAN|PRIMARY|SMALLINT|TINYINT|BIGINT|DOUBLE|SELECT|INSERT|VALUES|COLUMN|CREATE|DELETE|RENAME|FLOAT|WHERE|LIMIT|TABLE|ALTER|FALSE|TEXT|FROM|TYPE|DROP|TRUE|TO|INTO|ADD|AND|KEY|INT|IF|NOT|EXISTS)\b)` +
-		`|(?P<Func>(?i)\b(ADJ_PX|ADJ_VOL|ADJ)\b)` +
+		`|(?P<Now>(?i)\bNOW\s*\(\s*\))` +
+		`|(?P<Interval>(?i)\bINTERVAL\s*'[^']*')` +
+		`|(?P<TimeZone>(?i)\bAT\s+TIME\s+ZONE\b)` +
+		`|(?P<Keyword>(?i)\b(TIMESTAMP|DATABASE|BOOLEAN|PRIMARY|SMALLINT|TINYINT|BIGINT|DOUBLE|SELECT|INSERT|VALUES|COLUMN|CREATE|DELETE|RENAME|FLOAT|WHERE|LIMIT|TABLE|ALTER|FALSE|TEXT|FROM|TYPE|DROP|TRUE|TO|INTO|ADD|AND|KEY|INT|IF|NOT|EXISTS|GROUP|BY|DISTINCT|JOIN|ON|BETWEEN|OR|IN|ORDER|UPDATE|SET|DO|DEFAULT|NULL|IS|WITH)\b)` +
+		// function names only if "(" follows, so still usable as column names
+		`|(?P<Func>(?i)\b(ADJ_PX|ADJ_VOL|ADJ|TO_TIMEZONE)\s*\()` +
+		`|(?P<Agg>(?i)\b(APPROX_COUNT|COUNT|SUM|MIN|MAX|AVG|FIRST|LAST)\s*\()` +
 		`|(?P<Ident>[_a-zA-Z][a-zA-Z0-9_]*)` +
 		`|(?P<Number>-?\d+\.?\d*([eE][-+]?\d+)?)` +
 		`|(?P<String>'[^']*'|"[^"]*")` +
-		`|(?P<Operator><=|>=|[-+*/%,.()=<>?])`,
+		`|(?P<Operator><>|!=|<=|>=|[-+*/%,.()=<>?])`,
 	))
 	sqlParser = participle.MustBuild(
 		&Ast{},
 		participle.Lexer(sqlLexer),
 		participle.Unquote("String"),
-		participle.Upper("Keyword", "Func"),
+		participle.Upper("Keyword"),
+		participle.Map(funcName, "Func", "Agg"),
+		// soft keywords meaningful in one position only, e.g. AS, CASE, BUCKET, FILL, LATEST, ASOF,
+		// ALLOW FILTERING, ON CONFLICT DO NOTHING, SATURATE, OFFSET, ASC and DESC, still usable as names
+		participle.CaseInsensitive("Ident"),
 	)
 )
 
+// "count (" to "COUNT"
+func funcName(token lexer.Token) (lexer.Token, error) {
+	token.Value = strings.ToUpper(strings.TrimSpace(strings.TrimSuffix(token.Value, "(")))
+	return token, nil
+}
+
 type AstBoolean bool
 
 func (self *AstBoolean) Capture(values []string) error {
@@ -30,6 +48,46 @@ func (self *AstBoolean) Capture(values []string) error {
 	return nil
 }
 
+type AstDataType string
+
+func (self *AstDataType) Capture(values []string) error {
+	v := strings.ToUpper(values[0])
+	if _, ok := dataTypes[v]; !ok {
+		return errors.New("Unknown type " + values[0])
+	}
+	*self = AstDataType(v)
+	return nil
+}
+
+// INTERVAL '15 minutes' in nanoseconds
+type AstInterval int64
+
+func (self *AstInterval) Capture(values []string) error {
+	str := values[0]
+	str = str[strings.IndexByte(str, '\'')+1 : len(str)-1]
+	v, err := parseInterval(str)
+	*self = AstInterval(v)
+	return err
+}
+
+type AstTimeZone string
+
+func (self *AstTimeZone) Capture(values []string) error {
+	if _, err := time.LoadLocation(values[0]); err != nil {
+		return errors.New("Unknown time zone '" + values[0] + "'")
+	}
+	*self = AstTimeZone(values[0])
+	return nil
+}
+
+type AstTimestamp string
+
+func (self *AstTimestamp) Capture(values []string) error {
+	_, err := parseTimestampLiteral(values[0], time.UTC)
+	*self = AstTimestamp(values[0])
+	return err
+}
+
 type AstNumber struct {
 	Float *float64
 	Int   *int64
@@ -52,6 +110,7 @@ type Ast struct {
 	Create     *AstCreate     `| "CREATE" @@`
 	Drop       *AstDrop       `| "DROP" @@`
 	Delete     *AstDelete     `| "DELETE" @@`
+	Update     *AstUpdate     `| "UPDATE" @@`
 	AlterTable *AstAlterTable `| "ALTER" "TABLE" @@`
 }
 
@@ -70,6 +129,18 @@ type AstDelete struct {
 	Where *AstExpression `["WHERE" @@]`
 }
 
+type AstUpdate struct {
+	Table    *AstTableName  `@@`
+	Set      []AstSet       `"SET" @@ {"," @@}`
+	Where    *AstExpression `["WHERE" @@]`
+	Saturate *string        `[@"SATURATE"]`
+}
+
+type AstSet struct {
+	Col   *string   `@Ident "="`
+	Value *AstValue `@@`
+}
+
 type AstCreateDatabase struct {
 	IfNotExists *string `[@("IF" "NOT" "EXISTS")]`
 	Name        *string `@Ident`
@@ -79,18 +150,40 @@ type AstCreateTable struct {
 	IfNotExists *string       `[@("IF" "NOT" "EXISTS")]`
 	Name        *AstTableName `@@`
 	Cols        []AstTypeDef  `"(" @@ {"," @@} ")"`
+	Options     []AstOption   `["WITH" "(" @@ {"," @@} ")"]`
+}
+
+type AstOption struct {
+	Name  *string `@Ident "="`
+	Value *string `@String`
 }
 
 type AstTypeDef struct {
-	Key  []string `"PRIMARY" "KEY" "(" @Ident {"," @Ident} ")"`
-	Name *string  `| @Ident`
-	Type *string  `@{"BIGINT" | "TINYINT" | "SMALLINT" | "INT"  | "DOUBLE" | "FLOAT" | "TIMESTAMP" | "BOOLEAN" | "TEXT"}`
+	Key         []string           `"PRIMARY" "KEY" "(" @Ident {"," @Ident} ")"`
+	Name        *string            `| @Ident`
+	Type        *AstDataType       `@("BIGINT" | "TINYINT" | "SMALLINT" | "INT" | "DOUBLE" | "FLOAT" | "TIMESTAMP" | "BOOLEAN" | "TEXT" | Ident)`
+	Params      []int64            `["(" @Number {"," @Number} ")"]`
+	Constraints []AstColConstraint `{@@}`
+}
+
+type AstColConstraint struct {
+	NotNull *string   `@("NOT" "NULL")`
+	Null    *string   `| @"NULL"`
+	Default *AstValue `| "DEFAULT" @@`
 }
 
 type AstInsert struct {
-	Table  *AstTableName `"INTO" @@`
-	Cols   []string      `["(" @Ident {"," @Ident} ")"]`
-	Values []AstValue    `"VALUES" "(" @@ {"," @@} ")"`
+	Table       *AstTableName `"INTO" @@`
+	Cols        []string      `["(" @Ident {"," @Ident} ")"]`
+	Values      []AstValue    `"VALUES" "(" @@ {"," @@} ")"`
+	Rows        []AstRow      `{"," @@}`
+	IfNotExists *string       `[@("IF" "NOT" "EXISTS")]`
+	OnConflict  *string       `["ON" "CONFLICT" "DO" @("NOTHING" | "UPDATE")]`
+	Saturate    *string       `[@"SATURATE"]`
+}
+
+type AstRow struct {
+	Values []AstValue `"(" @@ {"," @@} ")"`
 }
 
 type AstTableName struct {
@@ -113,10 +206,43 @@ func (self *AstTableName) DatabaseName() string {
 }
 
 type AstSelect struct {
-	Selected *AstSelectExpression `@@`
-	Table    *AstTableName        `"FROM" @@`
-	Where    *AstExpression       `["WHERE" @@]`
-	Limit    *int64               `["LIMIT" @Number]`
+	Distinct       *string              `[@"DISTINCT"]`
+	Selected       *AstSelectExpression `@@`
+	Table          *AstTableName        `"FROM" @@`
+	Join           *AstAsofJoin         `["ASOF" "JOIN" @@]`
+	Where          *AstExpression       `["WHERE" @@]`
+	LatestBy       []string             `["LATEST" "BY" @Ident {"," @Ident}]`
+	GroupBy        []AstGroupBy         `["GROUP" "BY" @@ {"," @@}]`
+	Fill           *AstFill             `["FILL" "(" @@ ")"]`
+	OrderBy        *AstOrderBy          `["ORDER" "BY" @@]`
+	Limit          *int64               `["LIMIT" @Number`
+	Offset         *int64               `["OFFSET" @Number]]`
+	AllowFiltering *string              `[@("ALLOW" "FILTERING")]`
+}
+
+type AstOrderBy struct {
+	Col       *string `@Ident`
+	Direction *string `[@("ASC" | "DESC")]`
+}
+
+type AstAsofJoin struct {
+	Table *AstTableName `@@`
+	On    []string      `"ON" @Ident {"," @Ident}`
+}
+
+type AstGroupBy struct {
+	Bucket *AstBucket `@@`
+	Name   *string    `| @Ident`
+}
+
+type AstFill struct {
+	Mode  *string    `@("PREVIOUS" | "LINEAR" | "NULL")`
+	Value *AstNumber `| @Number`
+}
+
+type AstBucket struct {
+	Col      *string `"BUCKET" "(" @Ident`
+	Interval *string `"," @String ")"`
 }
 
 type AstAlterTable struct {
@@ -125,7 +251,23 @@ type AstAlterTable struct {
 }
 
 type AstAlterTableType struct {
-	Rename *AstRename `"RENAME" @@`
+	Rename *AstRename    `"RENAME" @@`
+	Add    *AstAddColumn `| "ADD" ["COLUMN"] @@`
+	Drop   *string       `| "DROP" ["COLUMN"] @Ident`
+	Alter  *AstAlterType `| "ALTER" ["COLUMN"] @@`
+}
+
+type AstAlterType struct {
+	Name   *string      `@Ident`
+	Type   *AstDataType `"TYPE" @("BIGINT" | "TINYINT" | "SMALLINT" | "INT" | "DOUBLE" | "FLOAT" | "TIMESTAMP" | "BOOLEAN" | "TEXT" | Ident)`
+	Params []int64      `["(" @Number {"," @Number} ")"]`
+}
+
+type AstAddColumn struct {
+	Name        *string            `@Ident`
+	Type        *AstDataType       `@("BIGINT" | "TINYINT" | "SMALLINT" | "INT" | "DOUBLE" | "FLOAT" | "TIMESTAMP" | "BOOLEAN" | "TEXT" | Ident)`
+	Params      []int64            `["(" @Number {"," @Number} ")"]`
+	Constraints []AstColConstraint `{@@}`
 }
 
 type AstRename struct {
@@ -138,25 +280,154 @@ type AstSelectExpression struct {
 	Cols []AstSelectCol `| @@ {"," @@}`
 }
 
+// Table, Name, Func and Agg are set by Parse if Expr is no more than one of them
 type AstSelectCol struct {
-	Name *string        `@Ident`
-	Func *AstSelectFunc `| @@`
+	Table *string
+	Name  *string
+	Func  *AstSelectFunc
+	Agg   *AstSelectAgg
+	Ohlcv *AstOhlcv
+	Expr  *AstExpr `@@`
+	Alias *string  `["AS" @Ident]`
+}
+
+type AstExpr struct {
+	Left  *AstTerm    `@@`
+	Right []AstOpTerm `{@@}`
+}
+
+type AstOpTerm struct {
+	Op    *string       `(@("+" | "-")`
+	Term  *AstTerm      `@@`
+	Minus *AstNegNumber `| @Number`
+	Right []AstOpFactor `{@@})`
+}
+
+// "-1" of "px-1", lexed as a negative number
+type AstNegNumber struct {
+	AstNumber
+}
+
+func (self *AstNegNumber) Capture(values []string) error {
+	if !strings.HasPrefix(values[0], "-") {
+		return errors.New("unexpected number " + values[0])
+	}
+	return self.AstNumber.Capture(values)
+}
+
+type AstTerm struct {
+	Left  *AstFactor    `@@`
+	Right []AstOpFactor `{@@}`
+}
+
+type AstOpFactor struct {
+	Op     *string    `@("*" | "/" | "%")`
+	Factor *AstFactor `@@`
+}
+
+type AstFactor struct {
+	Neg     *string        `[@"-"]`
+	Number  *AstNumber     `(@Number`
+	String  *string        `| @String`
+	Boolean *AstBoolean    `| @("TRUE" | "FALSE")`
+	Null    *string        `| @"NULL"`
+	Sub     *AstExpr       `| "(" @@ ")"`
+	Cast    *AstCast       `| "CAST" "(" @@ ")"`
+	Case    *AstCase       `| "CASE" @@ "END"`
+	Agg     *AstSelectAgg  `| @@`
+	Ohlcv   *AstOhlcv      `| @@`
+	Func    *AstSelectFunc `| @@`
+	Call    *AstCall       `| @@`
+	Col     *AstColRef     `| @@)`
+}
+
+// ohlcv(px, qty, '1m'[, '09:30-16:00'[, 'America/New_York']])
+type AstOhlcv struct {
+	Px       *AstOhlcvArg `"OHLCV" "(" @@`
+	Qty      *AstOhlcvArg `"," @@`
+	Interval *string      `"," @String`
+	Session  *string      `["," @String`
+	TimeZone *string      `["," @String]] ")"`
+}
+
+type AstOhlcvArg struct {
+	Func *AstSelectFunc `@@`
+	Col  *string        `| @Ident`
+}
+
+type AstColRef struct {
+	A *string `@Ident`
+	B *string `["." @Ident]`
+}
+
+type AstCast struct {
+	Expr   *AstExpr     `@@ "AS"`
+	Type   *AstDataType `@("BIGINT" | "TINYINT" | "SMALLINT" | "INT" | "DOUBLE" | "FLOAT" | "TIMESTAMP" | "BOOLEAN" | "TEXT" | Ident)`
+	Params []int64      `["(" @Number {"," @Number} ")"]`
+}
+
+// scalar function, e.g. ABS, ROUND, LOG
+type AstCall struct {
+	Name *string   `@Ident "("`
+	Args []AstExpr `[@@ {"," @@}] ")"`
+}
+
+type AstCase struct {
+	When []AstWhen `@@ {@@}`
+	Else *AstExpr  `["ELSE" @@]`
+}
+
+type AstWhen struct {
+	Cond *AstWhenCond `"WHEN" @@`
+	Then *AstExpr     `"THEN" @@`
+}
+
+type AstWhenCond struct {
+	And []AstCompare  `@@ {"AND" @@}`
+	Or  []AstWhenCond `{"OR" @@}`
+}
+
+type AstCompare struct {
+	LHS    *AstExpr `@@`
+	Op     *string  `(@("<>" | "!=" | "<=" | ">=" | "=" | "<" | ">")`
+	RHS    *AstExpr `@@`
+	IsNull *string  `| "IS" @("NOT" "NULL" | "NULL"))`
+}
+
+// the only factor of expr, nil if expr is more than that
+func (self *AstExpr) factor() *AstFactor {
+	if self.Right != nil || self.Left.Right != nil {
+		return nil
+	}
+	return self.Left.Left
+}
+
+type AstSelectAgg struct {
+	Name *string        `@Agg`
+	All  *string        `(@"*"`
+	Col  *string        `| @Ident`
+	Func *AstSelectFunc `| @@) ")"`
 }
 
 type AstSelectFunc struct {
-	Name   *string    `@Func "("`
+	Name   *string    `@Func`
 	Col    *string    `@Ident`
 	Params []AstValue `{"," @@} ")"`
 }
 
 type AstExpression struct {
-	And []AstCondition `@@ {"AND" @@}`
+	And []AstCondition  `@@ {"AND" @@}`
+	Or  []AstExpression `{"OR" @@}`
 }
 
 type AstCondition struct {
-	LHS      *string   `@Ident`
-	Operator *string   `@("<=" | ">=" | "=" | "<" | ">")`
-	RHS      *AstValue `@@`
+	Group    *AstExpression `"(" @@ ")"`
+	LHS      *string        `| @Ident`
+	Operator *string        `(@("<=" | ">=" | "=" | "<" | ">")`
+	RHS      *AstValue      `@@`
+	In       []AstValue     `| "IN" "(" @@ {"," @@} ")"`
+	Between  []AstValue     `| "BETWEEN" @@ "AND" @@`
+	IsNull   *string        `| "IS" @("NOT" "NULL" | "NULL"))`
 }
 
 type AstValue struct {
@@ -164,6 +435,41 @@ type AstValue struct {
 	String      *string     `| @String`
 	Placeholder *string     `| @"?"`
 	Boolean     *AstBoolean `| @("TRUE" | "FALSE")`
+	Null        *string     `| @"NULL"`
+	Time        *AstTime    `| @@`
+}
+
+type AstTime struct {
+	Now       *string         `(@Now`
+	Timestamp *AstTimestamp   `| "TIMESTAMP" @String`
+	TimeZone  *AstTimeZone    `[TimeZone @String])`
+	Offsets   []AstTimeOffset `{@@}`
+}
+
+type AstTimeOffset struct {
+	Sign     *string      `@("+" | "-")`
+	Interval *AstInterval `@Interval`
+}
+
+// relativeTime if NOW(), otherwise time.Time
+func (self *AstTime) Value() interface{} {
+	var offset int64
+	for _, o := range self.Offsets {
+		if *o.Sign == "-" {
+			offset -= int64(*o.Interval)
+		} else {
+			offset += int64(*o.Interval)
+		}
+	}
+	if self.Now != nil {
+		return relativeTime(offset)
+	}
+	loc := time.UTC
+	if self.TimeZone != nil {
+		loc, _ = time.LoadLocation(string(*self.TimeZone))
+	}
+	tm, _ := parseTimestampLiteral(string(*self.Timestamp), loc)
+	return tm.Add(time.Duration(offset))
 }
 
 func (self *AstValue) Value() interface{} {
@@ -179,11 +485,58 @@ func (self *AstValue) Value() interface{} {
 	if self.Boolean != nil {
 		return (bool)(*self.Boolean)
 	}
+	if self.Time != nil {
+		return self.Time.Value()
+	}
 	return nil
 }
 
 func Parse(sql string) (*Ast, error) {
 	expr := &Ast{}
 	err := sqlParser.ParseString(sql, expr)
+	if err == nil && expr.Select != nil {
+		expr.Select.Selected.simplify()
+		if expr.Select.OrderBy != nil {
+			upper(expr.Select.OrderBy.Direction)
+		}
+	}
+	if err == nil && expr.Insert != nil {
+		upper(expr.Insert.OnConflict)
+	}
 	return expr, err
 }
+
+// soft keywords are captured as written
+func upper(s *string) {
+	if s != nil {
+		*s = strings.ToUpper(*s)
+	}
+}
+
+// plain column, adj function, aggregate and ohlcv are not evaluated as expression
+func (self *AstSelectExpression) simplify() {
+	for i := range self.Cols {
+		col := &self.Cols[i]
+		f := col.Expr.factor()
+		if f == nil || f.Neg != nil {
+			continue
+		}
+		if f.Col != nil {
+			if f.Col.B == nil {
+				col.Name = f.Col.A
+			} else {
+				col.Table = f.Col.A
+				col.Name = f.Col.B
+			}
+		} else if f.Func != nil {
+			col.Func = f.Func
+		} else if f.Agg != nil {
+			col.Agg = f.Agg
+		} else if f.Ohlcv != nil {
+			col.Ohlcv = f.Ohlcv
+		} else {
+			continue
+		}
+		col.Expr = nil
+	}
+}
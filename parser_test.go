@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"strings"
 	"testing"
+	"time"
 )
 
 var sqlSelectStmt = "select a, adj(b) from test where a > 1.2 and b < 2 limit -2"
@@ -87,6 +88,38 @@ func Test_Parse(t *testing.T) {
 	assert.Equal(t, strings.TrimSpace(sqlInsertAst), repr.String(stmt, repr.Indent("  "), repr.OmitEmpty(true)))
 }
 
+func Test_ParseGroupBy(t *testing.T) {
+	stmt, err := Parse("select time, first(adj(px)), count(*) from trade where sec=1 group by sec, bucket(time, '5m')")
+	assert.Equal(t, nil, err)
+	cols := stmt.Select.Selected.Cols
+	assert.Equal(t, "FIRST", *cols[1].Agg.Name)
+	assert.Equal(t, "px", *cols[1].Agg.Func.Col)
+	assert.Equal(t, "*", *cols[2].Agg.All)
+	assert.Equal(t, "sec", *stmt.Select.GroupBy[0].Name)
+	assert.Equal(t, "time", *stmt.Select.GroupBy[1].Bucket.Col)
+	assert.Equal(t, "5m", *stmt.Select.GroupBy[1].Bucket.Interval)
+}
+
+func Test_ParseAsofJoin(t *testing.T) {
+	stmt, err := Parse("select time, trade.px, quote.bid from test.trade asof join test.quote on sec where sec=1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "quote", stmt.Select.Join.Table.TableName())
+	assert.Equal(t, []string{"sec"}, stmt.Select.Join.On)
+	assert.Equal(t, "trade", *stmt.Select.Selected.Cols[1].Table)
+	assert.Equal(t, "bid", *stmt.Select.Selected.Cols[2].Name)
+}
+
+func Test_ParseWhere(t *testing.T) {
+	stmt, err := Parse("select * from trade where sec in (1, ?, 3) and time between ? and ? or (sec=4 or sec=5) and qty>3")
+	assert.Equal(t, nil, err)
+	where := stmt.Select.Where
+	assert.Equal(t, 3, len(where.And[0].In))
+	assert.Equal(t, 2, len(where.And[1].Between))
+	assert.Equal(t, "sec", *where.Or[0].And[0].Group.And[0].LHS)
+	assert.Equal(t, "sec", *where.Or[0].And[0].Group.Or[0].And[0].LHS)
+	assert.Equal(t, "qty", *where.Or[0].And[1].LHS)
+}
+
 func Benchmark_Parse(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_, err := Parse(sqlSelectStmt)
@@ -96,6 +129,285 @@ func Benchmark_Parse(b *testing.B) {
 	}
 }
 
+func Test_ParseOrderBy(t *testing.T) {
+	stmt, err := Parse("select * from trade where sec=1 order by time desc limit 10 offset 20")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "time", *stmt.Select.OrderBy.Col)
+	assert.Equal(t, "DESC", *stmt.Select.OrderBy.Direction)
+	assert.Equal(t, int64(10), *stmt.Select.Limit)
+	assert.Equal(t, int64(20), *stmt.Select.Offset)
+	stmt, err = Parse("select * from trade order by sec")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*string)(nil), stmt.Select.OrderBy.Direction)
+	_, err = Parse("select * from trade offset 20")
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_ParseUpdate(t *testing.T) {
+	stmt, err := Parse("update test.trade set px=?, qty=100 where sec=1 and time=?")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "trade", stmt.Update.Table.TableName())
+	assert.Equal(t, 2, len(stmt.Update.Set))
+	assert.Equal(t, "qty", *stmt.Update.Set[1].Col)
+	assert.Equal(t, int64(100), *stmt.Update.Set[1].Value.Number.Int)
+	assert.Equal(t, 2, len(stmt.Update.Where.And))
+	_, err = Parse("update trade where sec=1")
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_ParseInsertConflict(t *testing.T) {
+	stmt, err := Parse("insert into trade values(?, ?, ?) if not exists")
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, (*string)(nil), stmt.Insert.IfNotExists)
+	stmt, err = Parse("insert into trade(a, b) values(?, ?) on conflict do nothing")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "NOTHING", *stmt.Insert.OnConflict)
+	stmt, err = Parse("insert into trade values(?, ?) on conflict do update")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "UPDATE", *stmt.Insert.OnConflict)
+	_, err = Parse("insert into trade values(?, ?) on conflict do delete")
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_ParseInsertRows(t *testing.T) {
+	stmt, err := Parse("insert into trade(a, b) values(1, ?), (2, 'x'), (?, ?) on conflict do nothing")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(stmt.Insert.Values))
+	assert.Equal(t, 2, len(stmt.Insert.Rows))
+	assert.Equal(t, "x", *stmt.Insert.Rows[0].Values[1].String)
+	assert.Equal(t, "NOTHING", *stmt.Insert.OnConflict)
+	stmt, err = Parse("insert into trade values(1, 2) saturate")
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, (*string)(nil), stmt.Insert.Saturate)
+	stmt, err = Parse("update trade set a=1 where b=2 saturate")
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, (*string)(nil), stmt.Update.Saturate)
+}
+
+func Test_ParseAlterColumn(t *testing.T) {
+	stmt, err := Parse("alter table trade add column venue text default 'XNAS'")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "venue", *stmt.AlterTable.AlterTableType.Add.Name)
+	assert.Equal(t, AstDataType("TEXT"), *stmt.AlterTable.AlterTableType.Add.Type)
+	assert.Equal(t, "XNAS", *stmt.AlterTable.AlterTableType.Add.Constraints[0].Default.String)
+	stmt, err = Parse("alter table trade add qty int")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(stmt.AlterTable.AlterTableType.Add.Constraints))
+	stmt, err = Parse("alter table trade drop column qty")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "qty", *stmt.AlterTable.AlterTableType.Drop)
+	stmt, err = Parse("alter table trade alter column qty type bigint")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "qty", *stmt.AlterTable.AlterTableType.Alter.Name)
+	assert.Equal(t, AstDataType("BIGINT"), *stmt.AlterTable.AlterTableType.Alter.Type)
+}
+
+func Test_ParseNull(t *testing.T) {
+	stmt, err := Parse("create table t(a int not null, b double default 1.5 not null, c text null, primary key(a))")
+	assert.Equal(t, nil, err)
+	cols := stmt.Create.Table.Cols
+	assert.Equal(t, "NOTNULL", *cols[0].Constraints[0].NotNull)
+	assert.Equal(t, 1.5, cols[1].Constraints[0].Default.Value())
+	assert.NotEqual(t, (*string)(nil), cols[1].Constraints[1].NotNull)
+	assert.NotEqual(t, (*string)(nil), cols[2].Constraints[0].Null)
+	stmt, err = Parse("select * from t where b is null or c is not null")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "NULL", *stmt.Select.Where.And[0].IsNull)
+	assert.Equal(t, "NOTNULL", *stmt.Select.Where.Or[0].And[0].IsNull)
+	stmt, err = Parse("insert into t values(1, null, ?)")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, stmt.Insert.Values[1].Value())
+}
+
+func Test_ParseDataType(t *testing.T) {
+	stmt, err := Parse("create table t(symbol symbol, px decimal(10, 4), qty Decimal, raw bytes, msg blob, primary key(symbol))")
+	assert.Equal(t, nil, err)
+	cols := stmt.Create.Table.Cols
+	assert.Equal(t, "symbol", *cols[0].Name)
+	assert.Equal(t, AstDataType("SYMBOL"), *cols[0].Type)
+	assert.Equal(t, []int64{10, 4}, cols[1].Params)
+	assert.Equal(t, AstDataType("DECIMAL"), *cols[2].Type)
+	assert.Equal(t, 0, len(cols[2].Params))
+	assert.Equal(t, Blob, parseDataType(string(*cols[3].Type)))
+	assert.Equal(t, Blob, parseDataType(string(*cols[4].Type)))
+	stmt, err = Parse("alter table t add column px2 decimal(8,2) default '1.5'")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int64{8, 2}, stmt.AlterTable.AlterTableType.Add.Params)
+	_, err = Parse("create table t(a varchar)")
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_ParseTime(t *testing.T) {
+	stmt, err := Parse("select * from t where time > now() - interval '15 minutes' and time < NOW()")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, relativeTime(-15*60*1e9), stmt.Select.Where.And[0].RHS.Value())
+	assert.Equal(t, relativeTime(0), stmt.Select.Where.And[1].RHS.Value())
+	stmt, err = Parse("select * from t where time >= TIMESTAMP '2026-01-02 09:30:00' AT TIME ZONE 'America/New_York' + INTERVAL '1h'")
+	assert.Equal(t, nil, err)
+	tm := stmt.Select.Where.And[0].RHS.Value().(time.Time)
+	assert.Equal(t, "2026-01-02T15:30:00Z", tm.UTC().Format(time.RFC3339))
+	stmt, err = Parse("select * from t where time = timestamp '2026-01-02T09:30:00.5+08:00'")
+	assert.Equal(t, nil, err)
+	tm = stmt.Select.Where.And[0].RHS.Value().(time.Time)
+	assert.Equal(t, "2026-01-02T01:30:00.5Z", tm.UTC().Format(time.RFC3339Nano))
+	stmt, err = Parse("select to_timezone(time, 'Asia/Tokyo'), interval from t where interval=1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "TO_TIMEZONE", *stmt.Select.Selected.Cols[0].Func.Name)
+	_, err = Parse("select * from t where time > now() - interval '1 parsec'")
+	assert.NotEqual(t, nil, err)
+	_, err = Parse("select * from t where time > timestamp '2026-13-01'")
+	assert.NotEqual(t, nil, err)
+	_, err = Parse("select * from t where time > timestamp '2026-01-01' at time zone 'Mars/X'")
+	assert.NotEqual(t, nil, err)
+	_, err = Parse("create table t(now int, interval int, zone int, at int, primary key(now))")
+	assert.Equal(t, nil, err)
+}
+
+func Test_ParseSelectExpr(t *testing.T) {
+	stmt, err := Parse("select px * qty as notional, (bid + ask) / 2 AS mid, px-1, trade.px, adj(px), count(*) from t")
+	assert.Equal(t, nil, err)
+	cols := stmt.Select.Selected.Cols
+	assert.Equal(t, "*", *cols[0].Expr.Left.Right[0].Op)
+	assert.Equal(t, "notional", *cols[0].Alias)
+	assert.Equal(t, "mid", *cols[1].Alias)
+	assert.Equal(t, int64(-1), *cols[2].Expr.Right[0].Minus.Int)
+	assert.Equal(t, (*AstExpr)(nil), cols[3].Expr)
+	assert.Equal(t, "trade", *cols[3].Table)
+	assert.Equal(t, "px", *cols[3].Name)
+	assert.Equal(t, "ADJ", *cols[4].Func.Name)
+	assert.Equal(t, "COUNT", *cols[5].Agg.Name)
+	stmt, err = Parse("select case when px > 1 and qty is not null then 'big' when px <> 0 or qty != 1 then 'x' else 'small' end, cast(px as decimal(10, 2)), round(px, 2) from t")
+	assert.Equal(t, nil, err)
+	cols = stmt.Select.Selected.Cols
+	assert.Equal(t, 2, len(cols[0].Expr.Left.Left.Case.When))
+	assert.Equal(t, AstDataType("DECIMAL"), *cols[1].Expr.Left.Left.Cast.Type)
+	assert.Equal(t, "round", *cols[2].Expr.Left.Left.Call.Name)
+	stmt, err = Parse("select case, end, cast, as from t")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "as", *stmt.Select.Selected.Cols[3].Name)
+	_, err = Parse("select px 1 from t")
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_ParseOhlcv(t *testing.T) {
+	stmt, err := Parse("select sec, ohlcv(adj(px), qty, '1m', '09:30-16:00', 'America/New_York') from trade")
+	assert.Equal(t, nil, err)
+	cols := stmt.Select.Selected.Cols
+	assert.Equal(t, "sec", *cols[0].Name)
+	o := cols[1].Ohlcv
+	assert.Equal(t, "ADJ", *o.Px.Func.Name)
+	assert.Equal(t, "px", *o.Px.Func.Col)
+	assert.Equal(t, "qty", *o.Qty.Col)
+	assert.Equal(t, "1m", *o.Interval)
+	assert.Equal(t, "09:30-16:00", *o.Session)
+	assert.Equal(t, "America/New_York", *o.TimeZone)
+	stmt, err = Parse("select OHLCV(px, qty, '5m') from trade")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*string)(nil), stmt.Select.Selected.Cols[0].Ohlcv.Session)
+	_, err = Parse("select ohlcv(px, qty) from trade")
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_ParseFill(t *testing.T) {
+	stmt, err := Parse("select time, last(px) from t where sec=1 group by bucket(time, '1m') fill(Previous) limit 10")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "Previous", *stmt.Select.Fill.Mode)
+	assert.Equal(t, int64(10), *stmt.Select.Limit)
+	stmt, err = Parse("select time, last(px) from t group by bucket(time, '1m') fill(-1.5)")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, -1.5, *stmt.Select.Fill.Value.Float)
+	_, err = Parse("select time, last(px) from t group by bucket(time, '1m') fill(next)")
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_ParseLatestBy(t *testing.T) {
+	stmt, err := Parse("select sec, adj(px) from quote where sec in (1, 2) latest by sec, interval limit 10")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"sec", "interval"}, stmt.Select.LatestBy)
+	_, err = Parse("select sec, px from quote latest sec")
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_ParseDistinct(t *testing.T) {
+	stmt, err := Parse("select distinct sec, interval from bar where sec > 1")
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, (*string)(nil), stmt.Select.Distinct)
+	assert.Equal(t, "interval", *stmt.Select.Selected.Cols[1].Name)
+	stmt, err = Parse("select sec from bar")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*string)(nil), stmt.Select.Distinct)
+}
+
+func Test_ParseApproxCount(t *testing.T) {
+	stmt, err := Parse("select approx_count(*) from trade where sec=1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "APPROX_COUNT", *stmt.Select.Selected.Cols[0].Agg.Name)
+}
+
+func Test_ParseFuncNameColumns(t *testing.T) {
+	stmt, err := Parse("create table t(sec int, time timestamp, last double, count int, adj double, primary key(sec, time))")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "last", *stmt.Create.Table.Cols[2].Name)
+	assert.Equal(t, "count", *stmt.Create.Table.Cols[3].Name)
+	stmt, err = Parse("select last, count, adj, last (last), count(*) from t where last > 1 and count = 2")
+	assert.Equal(t, nil, err)
+	cols := stmt.Select.Selected.Cols
+	assert.Equal(t, "last", *cols[0].Name)
+	assert.Equal(t, "count", *cols[1].Name)
+	assert.Equal(t, "adj", *cols[2].Name)
+	assert.Equal(t, "LAST", *cols[3].Agg.Name)
+	assert.Equal(t, "last", *cols[3].Agg.Col)
+	assert.Equal(t, "COUNT", *cols[4].Agg.Name)
+	assert.Equal(t, "last", *stmt.Select.Where.And[0].LHS)
+	assert.Equal(t, "count", *stmt.Select.Where.And[1].LHS)
+	stmt, err = Parse("insert into t(sec, time, last, count) values(1, 2, 3.5, 4)")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"sec", "time", "last", "count"}, stmt.Insert.Cols)
+}
+
+func Test_ParseKeywordColumns(t *testing.T) {
+	stmt, err := Parse("create table t(sec int, fill int, bucket int, latest int, asof int, allow int, filtering int, conflict int, nothing int, saturate int, offset int, asc int, desc int, primary key(sec, desc))")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "fill", *stmt.Create.Table.Cols[1].Name)
+	assert.Equal(t, "desc", *stmt.Create.Table.Cols[12].Name)
+	assert.Equal(t, []string{"sec", "desc"}, stmt.Create.Table.Cols[13].Key)
+	stmt, err = Parse("select bucket from t where sec=1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "bucket", *stmt.Select.Selected.Cols[0].Name)
+	stmt, err = Parse("select px from t where sec=1 and desc=2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "desc", *stmt.Select.Where.And[1].LHS)
+	stmt, err = Parse("select fill, latest, asof, offset from t where allow=1 and filtering>2 latest by latest order by asc desc limit 1 offset 2 allow filtering")
+	assert.Equal(t, nil, err)
+	cols := stmt.Select.Selected.Cols
+	assert.Equal(t, "fill", *cols[0].Name)
+	assert.Equal(t, "offset", *cols[3].Name)
+	assert.Equal(t, "allow", *stmt.Select.Where.And[0].LHS)
+	assert.Equal(t, "filtering", *stmt.Select.Where.And[1].LHS)
+	assert.Equal(t, []string{"latest"}, stmt.Select.LatestBy)
+	assert.Equal(t, "asc", *stmt.Select.OrderBy.Col)
+	assert.Equal(t, "DESC", *stmt.Select.OrderBy.Direction)
+	assert.Equal(t, int64(2), *stmt.Select.Offset)
+	assert.NotEqual(t, (*string)(nil), stmt.Select.AllowFiltering)
+	stmt, err = Parse("select bucket, count(*) from t asof join u on asof group by bucket, bucket(time, '1m') fill(previous)")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"asof"}, stmt.Select.Join.On)
+	assert.Equal(t, "bucket", *stmt.Select.GroupBy[0].Name)
+	assert.Equal(t, "time", *stmt.Select.GroupBy[1].Bucket.Col)
+	stmt, err = Parse("insert into t(sec, conflict, nothing, saturate) values(1, 2, 3, 4) on conflict do nothing saturate")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"sec", "conflict", "nothing", "saturate"}, stmt.Insert.Cols)
+	assert.Equal(t, "NOTHING", *stmt.Insert.OnConflict)
+	assert.NotEqual(t, (*string)(nil), stmt.Insert.Saturate)
+	stmt, err = Parse("update t set saturate=1, offset=2 where asc=3 saturate")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "saturate", *stmt.Update.Set[0].Col)
+	assert.Equal(t, "asc", *stmt.Update.Where.And[0].LHS)
+	assert.NotEqual(t, (*string)(nil), stmt.Update.Saturate)
+	_, err = Parse("alter table t add column bucket int")
+	assert.Equal(t, nil, err)
+}
+
 func Test_CreateTableSql(t *testing.T) {
 	sqlCreateTable1 := `
 	create table test.test(
@@ -115,4 +427,9 @@ func Test_CreateTableSql(t *testing.T) {
 
 	_, err = Parse("create table test.test(x x)")
 	assert.NotEqual(t, nil, err)
+
+	stmt, err := Parse("create table trade(sec int, time timestamp, primary key(sec, time)) with (storage = 'block')")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "storage", *stmt.Create.Table.Options[0].Name)
+	assert.Equal(t, "block", *stmt.Create.Table.Options[0].Value)
 }
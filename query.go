@@ -1,6 +1,7 @@
 package opentick
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
@@ -8,8 +9,10 @@ import (
 	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,15 +23,16 @@ func Resolve(db fdb.Transactor, dbName string, ast *Ast, user ...*User) (stmt in
 		return resolveInsert(db, dbName, ast.Insert, user...)
 	} else if ast.Delete != nil {
 		return resolveDelete(db, dbName, ast.Delete, user...)
+	} else if ast.Update != nil {
+		return resolveUpdate(db, dbName, ast.Update, user...)
 	}
-	err = errors.New("Only select/insert/delete can be resolved")
+	err = errors.New("Only select/insert/delete/update can be resolved")
 	return
 }
 
 func ExecuteStmt(db fdb.Transactor, stmt interface{}, args []interface{}) (res [][]interface{}, err error) {
 	if stmt2, ok := stmt.(insertStmt); ok {
-		err = executeInsert(db, &stmt2, args)
-		return
+		return executeInsert(db, &stmt2, args)
 	}
 	if stmt2, ok := stmt.(selectStmt); ok {
 		return executeSelect(db, &stmt2, args)
@@ -37,10 +41,54 @@ func ExecuteStmt(db fdb.Transactor, stmt interface{}, args []interface{}) (res [
 		err = executeDelete(db, &stmt2, args)
 		return
 	}
+	if stmt2, ok := stmt.(updateStmt); ok {
+		err = executeUpdate(db, &stmt2, args)
+		return
+	}
 	err = errors.New("Invalid statement")
 	return
 }
 
+// like ExecuteStmt, but rows of select are passed to fn page by page
+func ExecuteStmtStream(db fdb.Transactor, stmt interface{}, args []interface{}, fn func([][]interface{}) error) (err error) {
+	if stmt2, ok := stmt.(selectStmt); ok {
+		return streamSelect(db, &stmt2, args, true, fn)
+	}
+	res, err := ExecuteStmt(db, stmt, args)
+	if err != nil {
+		return
+	}
+	return fn(res)
+}
+
+// like Execute, but rows of select are passed to fn page by page
+func ExecuteStream(db fdb.Transactor, dbName string, sql string, args []interface{}, fn func([][]interface{}) error, user ...*User) (err error) {
+	ast, err := Parse(sql)
+	if err != nil {
+		return
+	}
+	if ast.Select == nil {
+		res, err := Execute(db, dbName, sql, args, user...)
+		if err != nil {
+			return err
+		}
+		return fn(res)
+	}
+	stmt, err := Resolve(db, dbName, ast, user...)
+	if err != nil {
+		return
+	}
+	err = ExecuteStmtStream(db, stmt, args, fn)
+	if isSchemaAltered(err) {
+		// failed before any rows passed
+		if stmt, err = Resolve(db, dbName, ast, user...); err != nil {
+			return
+		}
+		err = ExecuteStmtStream(db, stmt, args, fn)
+	}
+	return
+}
+
 func Execute(db fdb.Transactor, dbName string, sql string, args []interface{}, user ...*User) (res [][]interface{}, err error) {
 	ast, err1 := Parse(sql)
 	if err1 != nil {
@@ -113,315 +161,1339 @@ func Execute(db fdb.Transactor, dbName string, sql string, args []interface{}, u
 			err = err1
 			return
 		}
-		return ExecuteStmt(db, stmt, args)
+		res, err = ExecuteStmt(db, stmt, args)
+		if isSchemaAltered(err) {
+			if stmt, err = Resolve(db, dbName, ast, user...); err != nil {
+				return
+			}
+			res, err = ExecuteStmt(db, stmt, args)
+		}
 	}
 	return
 }
 
 func executeSelect(db fdb.Transactor, stmt *selectStmt, args []interface{}) (res [][]interface{}, err error) {
-	sel, conds, err1 := executeWhere(db, stmt, args)
-	if err1 != nil {
-		err = err1
+	err = streamSelect(db, stmt, args, false, func(rows [][]interface{}) error {
+		res = append(res, rows...)
+		return nil
+	})
+	return
+}
+
+// rows of plain select are passed to fn page by page, every page read in its own transaction,
+// aggregates are computed page by page and passed at once. ASOF JOIN and overlapped OR branches
+// are read in memory, and fail if stream is set
+func streamSelect(db fdb.Transactor, stmt *selectStmt, args []interface{}, stream bool, fn func([][]interface{}) error) (err error) {
+	if err = checkSchemaForRead(db, stmt.Schema); err != nil {
 		return
 	}
-	if bytes, ok := sel.([]byte); ok {
-		tmp, err1 := db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
-			ret = tr.Get(fdb.Key(bytes)).MustGet()
-			return
-		})
-		if err1 != nil {
-			err = err1
+	if stmt.Join != nil {
+		if err = checkSchemaForRead(db, stmt.Join.Schema); err != nil {
 			return
 		}
-		bytes = tmp.([]byte)
-		if len(bytes) == 0 {
+	}
+	ranges, err := executeWhere(db, stmt, args)
+	if err != nil {
+		return
+	}
+	output := func(res [][]interface{}) (err error) {
+		if err = formatOutput(db, stmt, res); err != nil {
 			return
 		}
-		value, err2 := tuple.Unpack(bytes)
-		if err2 != nil {
-			err = errors.New("Internal errror: " + err2.Error())
+		if stmt.Exprs != nil {
+			if res, err = evalExprs(stmt.Exprs, res); err != nil {
+				return
+			}
+		}
+		return fn(res)
+	}
+	limit := stmt.Limit
+	if stmt.Aggs != nil {
+		limit = 0
+	} else if limit > 0 {
+		limit += stmt.Offset
+	}
+	if stmt.Count == "approx_count" || stmt.Count == "count" && disjointRanges(ranges) {
+		res, err := executeCount(db, stmt, ranges)
+		if err != nil {
+			return err
+		}
+		return output(res)
+	}
+	var fill *fillGrid
+	if stmt.Fill != nil {
+		fill, err = stmt.Fill.grid(stmt, ranges)
+		if err != nil {
 			return
 		}
-		res = []([]interface{}){make([]interface{}, len(stmt.Cols))}
-		applyFuncOne(db, stmt, value)
-		for i, col := range stmt.Cols {
-			if col.IsKey {
-				res[0][i] = conds[col.Pos].Equal
-			} else if int(col.Pos) < len(value) {
-				res[0][i] = value[col.Pos]
-			}
+		_, err = db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
+			fill.Prev, err = readPrevious(tr, stmt.Schema, ranges)
+			return
+		})
+		if err != nil {
+			return
 		}
-		return
 	}
-	kr := sel.(fdb.KeyRange)
-	tmp, err2 := db.Transact(func(tr fdb.Transaction) (interface{}, error) {
-		return tr.GetRange(kr, fdb.RangeOptions{Limit: stmt.Limit, Reverse: stmt.Reverse}).GetSliceWithError()
-	})
-	if err2 != nil {
-		err = err2
-		return
+	disjoint := disjointRanges(ranges)
+	if stream && (stmt.Join != nil || stmt.Latest == 0 && stmt.Distinct == 0 && !disjoint) {
+		return errors.New("Select with ASOF JOIN or overlapped OR branches cannot be streamed")
 	}
-	if tmp == nil {
-		return
+	var recs [][2]tuple.Tuple
+	if stmt.Latest == 0 && stmt.Distinct == 0 && disjoint {
+		sortRanges(ranges, stmt.Reverse)
+		if stmt.Aggs != nil && stmt.Join == nil {
+			agg := newAggregator(stmt)
+			err = scanRanges(db, stmt.Schema, ranges, limit, stmt.Reverse, func(page [][2]tuple.Tuple) error {
+				applyFunc(db, stmt, page)
+				agg.add(page)
+				return nil
+			})
+			if err != nil {
+				return
+			}
+			if fill != nil {
+				applyFunc(db, stmt, fill.Prev)
+			}
+			return output(agg.result(fill))
+		}
+		if stmt.Aggs == nil && stmt.Join == nil {
+			skip := stmt.Offset
+			return scanRanges(db, stmt.Schema, ranges, limit, stmt.Reverse, func(page [][2]tuple.Tuple) error {
+				if skip >= len(page) {
+					skip -= len(page)
+					return nil
+				}
+				page = page[skip:]
+				skip = 0
+				applyFunc(db, stmt, page)
+				return output(projectRecords(stmt, page))
+			})
+		}
+		err = scanRanges(db, stmt.Schema, ranges, limit, stmt.Reverse, func(page [][2]tuple.Tuple) error {
+			recs = append(recs, page...)
+			return nil
+		})
+	} else {
+		recs, err = readRanges(db, stmt, ranges, limit)
 	}
-	recs := tmp.([]fdb.KeyValue)
-	if len(recs) == 0 {
+	if err != nil {
 		return
 	}
-	tmpRes := make([][2]tuple.Tuple, len(recs))
-	for i, rec := range recs {
-		key, err1 := stmt.Schema.Dir.Unpack(rec.Key)
-		if err1 != nil {
-			err = errors.New("Internal errror: " + err1.Error())
+	if stmt.Aggs == nil && stmt.Offset > 0 {
+		if stmt.Offset >= len(recs) {
 			return
 		}
-		value, err2 := tuple.Unpack(rec.Value)
-		if err2 != nil {
-			err = errors.New("Internal errror: " + err2.Error())
+		recs = recs[stmt.Offset:]
+	}
+	applyFunc(db, stmt, recs)
+	if fill != nil {
+		applyFunc(db, stmt, fill.Prev)
+	}
+	var res [][]interface{}
+	if stmt.Join != nil {
+		res, err = executeAsofJoin(db, stmt, recs)
+		if err != nil {
 			return
 		}
-		tmpRes[i] = [2]tuple.Tuple{key, value}
+	} else if stmt.Aggs != nil {
+		res = aggregate(stmt, recs, fill)
+	} else {
+		res = projectRecords(stmt, recs)
+	}
+	if len(res) == 0 && stmt.Aggs == nil {
+		return
+	}
+	return output(res)
+}
+
+func projectRecords(stmt *selectStmt, recs [][2]tuple.Tuple) (res [][]interface{}) {
+	if len(recs) == 0 {
+		return
 	}
-	applyFunc(db, stmt, tmpRes)
 	res = make([]([]interface{}), len(recs))
-	for i, tmp := range tmpRes {
-		key, value := tmp[0], tmp[1]
+	for i, rec := range recs {
 		row := make([]interface{}, len(stmt.Cols))
 		res[i] = row
 		for j, col := range stmt.Cols {
-			if col.IsKey {
-				if int(col.Pos) < len(key) {
-					row[j] = key[col.Pos]
-				}
-			} else if int(col.Pos) < len(value) {
-				row[j] = value[col.Pos]
-			}
+			row[j] = getColValue(col, rec)
 		}
 	}
 	return
 }
 
-func executeDelete(db fdb.Transactor, stmt *deleteStmt, args []interface{}) (err error) {
-	if stmt.Schema.TblName == "_adj_" {
-		adjCache.clear(stmt.Schema.DbName)
+// ranges read at most this many at once
+var maxReadWorkers = 16
+
+// ranges read concurrently, every one page by page as scanRanges, records merged in key order
+func readRanges(db fdb.Transactor, stmt *selectStmt, ranges []whereRange, limit int) (recs [][2]tuple.Tuple, err error) {
+	readLimit, reverse := limit, stmt.Reverse
+	if stmt.Latest > 0 {
+		readLimit, reverse = 1, true
 	}
-	tmp, _, err1 := executeWhere(db, stmt, args)
-	if err1 != nil {
-		err = err1
+	read := func(r *whereRange) (res []record, err error) {
+		if stmt.Distinct > 0 {
+			return readDistinct(db, stmt.Schema, r, stmt.Distinct, limit, stmt.Reverse)
+		}
+		err = scanRecords(db, stmt.Schema, []whereRange{*r}, readLimit, reverse, func(page []record) error {
+			res = append(res, page...)
+			return nil
+		})
 		return
 	}
-	if bytes, ok := tmp.([]byte); ok {
-		_, err = db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
-			tr.Clear(fdb.Key(bytes))
+	results := make([][]record, len(ranges))
+	errs := make([]error, len(ranges))
+	workers := make(chan struct{}, maxReadWorkers)
+	var wg sync.WaitGroup
+	for i := range ranges {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			results[i], errs[i] = read(&ranges[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err = range errs {
+		if err != nil {
 			return
-		})
+		}
+	}
+	if stmt.Latest > 0 {
+		recs = latestRecords(mergeRecords(results, 0, false), stmt.Latest, limit)
+	} else if stmt.Distinct > 0 {
+		// one record per prefix
+		recs = latestRecords(mergeRecords(results, 0, stmt.Reverse), stmt.Distinct, limit)
+	} else {
+		recs = mergeRecords(results, limit, stmt.Reverse)
+	}
+	return
+}
+
+// convert stored values for reply: decimal, symbol id and to_timezone
+func formatOutput(db fdb.Transactor, stmt *selectStmt, res [][]interface{}) (err error) {
+	if len(res) == 0 {
 		return
 	}
-	kr := tmp.(fdb.KeyRange)
-	_, err = db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
-		tr.ClearRange(kr)
+	dicts := make([]*symbolDict, len(stmt.Cols))
+	found := false
+	for j, col := range stmt.Cols {
+		if f := stmt.Funcs; f != nil && f[j] != nil && f[j].Loc != nil && (stmt.Aggs == nil || stmt.Aggs[j] == nil || stmt.Aggs[j].Name != "count") {
+			for _, row := range res {
+				row[j] = formatTimestamp(row[j], stmt.Funcs[j].Loc)
+			}
+			continue
+		}
+		dbName := stmt.Schema.DbName
+		if col == nil && stmt.Join != nil {
+			col = stmt.Join.Cols[j]
+			dbName = stmt.Join.Schema.DbName
+		}
+		if col == nil || stmt.Aggs != nil && stmt.Aggs[j] != nil && stmt.Aggs[j].Name == "count" {
+			continue
+		}
+		switch col.Type {
+		case Decimal:
+			for _, row := range res {
+				switch v := row[j].(type) {
+				case int64:
+					row[j] = formatDecimal(v, col.Scale)
+				case float64:
+					// avg
+					row[j] = v / float64(pow10[col.Scale])
+				}
+			}
+		case Symbol:
+			dicts[j], err = getSymbolDict(db, dbName)
+			if err != nil {
+				return
+			}
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+	_, err = db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, err error) {
+		for _, row := range res {
+			for j, dict := range dicts {
+				if v, ok := row[j].(int64); ok && dict != nil {
+					if row[j], err = dict.name(tr, v); err != nil {
+						return
+					}
+				}
+			}
+		}
 		return
 	})
 	return
 }
 
-func executeWhere(db fdb.Transactor, stmt whereStmt, args []interface{}) (res interface{}, conds []condition, err error) {
-	np := stmt.GetNumPlaceholders()
-	if np != len(args) {
-		err = errors.New("Expected " + strconv.FormatInt(int64(np), 10) + " arguments, got " + strconv.FormatInt(int64(len(args)), 10))
+type record struct {
+	key []byte
+	rec [2]tuple.Tuple
+}
+
+func readRange(tr fdb.Transaction, schema *TableSchema, r *whereRange, limit int, reverse bool) (recs []record, err error) {
+	if r.Key != nil {
+		bytes, err1 := getRow(tr, schema, fdb.Key(r.Key))
+		if err1 != nil || len(bytes) == 0 {
+			err = err1
+			return
+		}
+		value, err2 := tuple.Unpack(bytes)
+		if err2 != nil {
+			err = errors.New("Internal errror: " + err2.Error())
+			return
+		}
+		key := make(tuple.Tuple, len(r.Conds))
+		for i := range r.Conds {
+			key[i] = r.Conds[i].Equal
+		}
+		if rec := [2]tuple.Tuple{key, schema.decodeValue(value)}; matchFilters(r.Filters, rec) {
+			recs = []record{{r.Key, rec}}
+		}
 		return
 	}
-	conds = stmt.GetConds()
-	schema := stmt.GetSchema()
-	if conds == nil {
-		kr := fdb.KeyRange{}
-		a, b := schema.Dir.FDBRangeKeys()
-		kr.Begin = a
-		kr.End = b
-		res = kr
+	opts := fdb.RangeOptions{Limit: limit, Reverse: reverse}
+	if r.Filters == nil {
+		kvs, err1 := getRange(tr, schema, r.Range, opts)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		recs = make([]record, len(kvs))
+		for i, kv := range kvs {
+			recs[i].key = kv.Key
+			recs[i].rec, err = unpackRecord(schema, kv)
+			if err != nil {
+				return
+			}
+		}
 		return
 	}
-	if len(args) > 0 {
-		conds, err = validateConditionArgs(schema, conds, args)
-		if err != nil {
+	// residual predicates, limit applied after filtering
+	opts.Limit = 0
+	var iter interface {
+		Advance() bool
+		Get() (fdb.KeyValue, error)
+	}
+	if schema.blocks() {
+		kvs, err1 := getRange(tr, schema, r.Range, opts)
+		if err1 != nil {
+			err = err1
 			return
 		}
+		iter = &kvIterator{kvs: kvs}
+	} else {
+		iter = decompressIterator{tr.GetRange(r.Range, opts).Iterator(), schema}
 	}
-	var sub subspace.Subspace
-	sub = schema.Dir
-	n := len(conds) - 1
-	if n > 0 {
-		for i := range conds[:n] {
-			sub = sub.Sub(conds[i].Equal)
+	for iter.Advance() {
+		kv, err1 := iter.Get()
+		if err1 != nil {
+			err = err1
+			return
+		}
+		rec, err2 := unpackRecord(schema, kv)
+		if err2 != nil {
+			err = err2
+			return
+		}
+		if !matchFilters(r.Filters, rec) {
+			continue
+		}
+		recs = append(recs, record{kv.Key, rec})
+		if limit > 0 && len(recs) >= limit {
+			break
 		}
 	}
-	c := &conds[n]
-	if c.Equal != nil && len(conds) == len(schema.Keys) {
-		res = sub.Sub(c.Equal).Bytes()
-		return
-	}
-	kr := fdb.KeyRange{}
-	if c.Equal != nil {
-		a, b := sub.Sub(c.Equal).FDBRangeKeys()
-		kr.Begin = a
-		kr.End = b
-	} else {
-		if c.Start[0] != nil {
-			k := sub.Sub(c.Start[0])
-			if c.Start[1] == nil {
-				kr.Begin = fdb.Key(append(k.Bytes(), 0x1))
-			} else {
-				kr.Begin = k
-			}
-		} else {
-			kr.Begin = fdb.Key(append(sub.Bytes(), 0x00))
+	return
+}
+
+// merge records of multiple ranges in key order, a record matched by more than one range is kept once
+func mergeRecords(results [][]record, limit int, reverse bool) (recs [][2]tuple.Tuple) {
+	all := results[0]
+	if len(results) > 1 {
+		all = nil
+		for _, tmp := range results {
+			all = append(all, tmp...)
 		}
-		if c.End[0] != nil {
-			k := sub.Sub(c.End[0])
-			if c.End[1] == nil {
-				kr.End = k
-			} else {
-				kr.End = fdb.Key(append(k.Bytes(), 0x1))
+		sort.SliceStable(all, func(i, j int) bool {
+			c := bytes.Compare(all[i].key, all[j].key)
+			if reverse {
+				return c > 0
 			}
-		} else {
-			kr.End = fdb.Key(append(sub.Bytes(), 0xFF))
+			return c < 0
+		})
+	}
+	recs = make([][2]tuple.Tuple, 0, len(all))
+	for i, r := range all {
+		if i > 0 && bytes.Equal(r.key, all[i-1].key) {
+			continue
+		}
+		if limit > 0 && len(recs) >= limit {
+			break
 		}
+		recs = append(recs, r.rec)
+	}
+	return
+}
+
+func unpackRecord(schema *TableSchema, kv fdb.KeyValue) (rec [2]tuple.Tuple, err error) {
+	key, err1 := schema.Dir.Unpack(kv.Key)
+	if err1 != nil {
+		err = errors.New("Internal errror: " + err1.Error())
+		return
+	}
+	value, err2 := tuple.Unpack(kv.Value)
+	if err2 != nil {
+		err = errors.New("Internal errror: " + err2.Error())
+		return
 	}
-	res = kr
+	rec = [2]tuple.Tuple{key, schema.decodeValue(value)}
 	return
 }
 
-func BatchInsert(db fdb.Transactor, stmt *insertStmt, argsArray [][]interface{}) (err error) {
+func getColValue(col *TableColDef, rec [2]tuple.Tuple) interface{} {
+	if col.IsKey {
+		if int(col.Pos) < len(rec[0]) {
+			return rec[0][col.Pos]
+		}
+	} else if int(col.Pos) < len(rec[1]) {
+		return rec[1][col.Pos]
+	}
+	return nil
+}
+
+func executeDelete(db fdb.Transactor, stmt *deleteStmt, args []interface{}) (err error) {
+	if stmt.Schema.TblName == "_adj_" {
+		adjCache.clear(stmt.Schema.DbName)
+	}
+	ranges, err1 := executeWhere(db, stmt, args)
+	if err1 != nil {
+		err = err1
+		return
+	}
 	_, err = db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
-		for _, args := range argsArray {
-			var parts [2][]tuple.TupleElement
-			err = prepareInsert(stmt, args, &parts)
+		if err = checkSchema(tr, stmt.Schema); err != nil {
+			return
+		}
+		for _, r := range ranges {
+			if r.Key != nil {
+				err = clearRow(tr, stmt.Schema, fdb.Key(r.Key))
+			} else {
+				err = clearRange(tr, stmt.Schema, r.Range)
+			}
 			if err != nil {
 				return
 			}
-			tr.Set(stmt.Schema.Dir.Pack(tuple.Tuple(parts[0])), tuple.Tuple(parts[1]).Pack())
 		}
 		return
 	})
 	return
 }
 
-func prepareInsert(stmt *insertStmt, args []interface{}, parts *[2][]tuple.TupleElement) (err error) {
+func executeUpdate(db fdb.Transactor, stmt *updateStmt, args []interface{}) (err error) {
 	if stmt.NumPlaceholders != len(args) {
 		err = errors.New("Expected " + strconv.FormatInt(int64(stmt.NumPlaceholders), 10) + " arguments, got " + strconv.FormatInt(int64(len(args)), 10))
 		return
 	}
-	values := stmt.Values
-	if len(args) > 0 {
-		values = make([]interface{}, len(stmt.Values))
-		copy(values, stmt.Values)
+	if stmt.Schema.TblName == "_adj_" {
+		adjCache.clear(stmt.Schema.DbName)
+	}
+	n := stmt.NumPlaceholders - stmt.NumWherePlaceholders
+	values := make([]interface{}, len(stmt.Values))
+	now := time.Now().UnixNano()
+	for i, v := range stmt.Values {
+		values[i] = evalRelativeTime(v, now)
+	}
+	if n > 0 {
 		for i := range values {
 			if p, ok := values[i].(placeholder); ok {
-				values[i], err = validateValue(stmt.Schema.Cols[i], args[int(p)])
+				values[i], err = validateValue(stmt.Cols[i], args[int(p)], stmt.Saturate)
 				if err != nil {
 					return
 				}
 			}
 		}
 	}
-	for i, cols := range [2]([]*TableColDef){stmt.Schema.Keys, stmt.Schema.Values} {
-		parts[i] = make([]tuple.TupleElement, len(cols))
-		for _, col := range cols {
-			v := values[col.PosCol]
-			parts[i][col.Pos] = tuple.TupleElement(v)
-		}
-	}
-	return
-}
-
-func executeInsert(db fdb.Transactor, stmt *insertStmt, args []interface{}) (err error) {
-	if stmt.Schema.TblName == "_adj_" {
-		adjCache.clear(stmt.Schema.DbName)
+	ranges, err1 := executeWhere(db, stmt, args[n:])
+	if err1 != nil {
+		err = err1
+		return
 	}
-	argsArray := [1][]interface{}{args}
-	return BatchInsert(db, stmt, argsArray[:])
-}
-
-func resolveSelect(db fdb.Transactor, dbName string, ast *AstSelect, user ...*User) (stmt selectStmt, err error) {
-	stmt.Schema, err = getTableSchema(db, dbName, ast.Table)
-	schema := stmt.Schema
+	dict, err := getSchemaSymbolDict(db, stmt.Schema)
 	if err != nil {
 		return
 	}
-	if GetPerm(schema.DbName, schema.TblName, user...) == NoPerm {
-		err = errors.New("No permisssion")
+	update := func(bytes []byte, values []interface{}) (ret []byte, err error) {
+		value, err1 := tuple.Unpack(bytes)
+		if err1 != nil {
+			err = errors.New("Internal errror: " + err1.Error())
+			return
+		}
+		value = stmt.Schema.decodeValue(value)
+		for i, col := range stmt.Cols {
+			value[col.Pos] = values[i]
+		}
+		ret = value.Pack()
 		return
 	}
-	stmt.Conds, stmt.NumPlaceholders, err = resolveWhere(stmt.Schema, ast.Where)
+	_, err = db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
+		if err = checkSchema(tr, stmt.Schema); err != nil {
+			return
+		}
+		values := values
+		if dict != nil {
+			// ids assigned by failed attempt must not be reused on retry
+			values = append([]interface{}{}, values...)
+			for i, v := range values {
+				if s, ok := v.(symbol); ok {
+					values[i], err = dict.assign(tr, string(s))
+					if err != nil {
+						return
+					}
+				}
+			}
+		}
+		var keys []fdb.Key
+		var updated [][]byte
+		for _, r := range ranges {
+			var kvs []fdb.KeyValue
+			if r.Key != nil {
+				bytes, err1 := getRow(tr, stmt.Schema, fdb.Key(r.Key))
+				if err1 != nil {
+					err = err1
+					return
+				}
+				if bytes != nil {
+					kvs = []fdb.KeyValue{{Key: fdb.Key(r.Key), Value: bytes}}
+				}
+			} else {
+				kvs, err = getRange(tr, stmt.Schema, r.Range, fdb.RangeOptions{})
+				if err != nil {
+					return
+				}
+			}
+			for _, kv := range kvs {
+				value, err1 := update(kv.Value, values)
+				if err1 != nil {
+					err = err1
+					return
+				}
+				keys = append(keys, kv.Key)
+				updated = append(updated, value)
+			}
+		}
+		err = setRows(tr, stmt.Schema, keys, updated)
+		return
+	})
+	return
+}
+
+type whereRange struct {
+	Key     []byte // set if all keys restricted by equal
+	Range   fdb.KeyRange
+	Conds   []condition
+	Filters []filter
+}
+
+func executeWhere(db fdb.Transactor, stmt whereStmt, args []interface{}) (res []whereRange, err error) {
+	np := stmt.GetNumPlaceholders()
+	if np != len(args) {
+		err = errors.New("Expected " + strconv.FormatInt(int64(np), 10) + " arguments, got " + strconv.FormatInt(int64(len(args)), 10))
+		return
+	}
+	schema := stmt.GetSchema()
+	branches := stmt.GetWhere()
+	if branches == nil {
+		a, b := schema.Dir.FDBRangeKeys()
+		res = []whereRange{{Range: fdb.KeyRange{Begin: a, End: b}}}
+		return
+	}
+	res = make([]whereRange, len(branches))
+	for i, branch := range branches {
+		r := &res[i]
+		r.Conds = branch.Conds
+		r.Filters = branch.Filters
+		if len(args) > 0 {
+			r.Conds, err = validateConditionArgs(schema, r.Conds, args)
+			if err != nil {
+				return
+			}
+			r.Filters, err = validateFilterArgs(r.Filters, args)
+			if err != nil {
+				return
+			}
+		}
+	}
+	evalRangesTime(res, time.Now().UnixNano())
+	dict, err := getSchemaSymbolDict(db, schema)
+	if err != nil {
+		return
+	}
+	if dict != nil {
+		err = dict.lookupRanges(db, res)
+		if err != nil {
+			return
+		}
+	}
+	for i := range res {
+		r := &res[i]
+		conds := r.Conds
+		if conds == nil {
+			a, b := schema.Dir.FDBRangeKeys()
+			r.Range = fdb.KeyRange{Begin: a, End: b}
+			continue
+		}
+		var sub subspace.Subspace
+		sub = schema.Dir
+		n := len(conds) - 1
+		if n > 0 {
+			for i := range conds[:n] {
+				sub = sub.Sub(conds[i].Equal)
+			}
+		}
+		c := &conds[n]
+		if c.Equal != nil && len(conds) == len(schema.Keys) {
+			r.Key = sub.Sub(c.Equal).Bytes()
+			continue
+		}
+		kr := fdb.KeyRange{}
+		if c.Equal != nil {
+			a, b := sub.Sub(c.Equal).FDBRangeKeys()
+			kr.Begin = a
+			kr.End = b
+		} else {
+			if c.Start[0] != nil {
+				k := sub.Sub(c.Start[0])
+				if c.Start[1] == nil {
+					// skip k and all keys under it
+					_, kr.Begin = k.FDBRangeKeys()
+				} else {
+					kr.Begin = k
+				}
+			} else {
+				kr.Begin = fdb.Key(append(sub.Bytes(), 0x00))
+			}
+			if c.End[0] != nil {
+				k := sub.Sub(c.End[0])
+				if c.End[1] == nil {
+					kr.End = k
+				} else {
+					_, kr.End = k.FDBRangeKeys()
+				}
+			} else {
+				kr.End = fdb.Key(append(sub.Bytes(), 0xFF))
+			}
+		}
+		r.Range = kr
+	}
+	return
+}
+
+// every args of argsArray is applied to all rows of stmt,
+// returns [existed] of every row written if stmt has conflict clause,
+// IF NOT EXISTS of more than one row fails with the existing ones instead, and fails if more than one transaction.
+// Large batch is split into transactions between args, if one fails after others committed,
+// the error tells how many rows were committed so that the rest can be resumed
+func BatchInsert(db fdb.Transactor, stmt *insertStmt, argsArray [][]interface{}) (res [][]interface{}, err error) {
+	dict, err := getSchemaSymbolDict(db, stmt.Schema)
+	if err != nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	n := len(argsArray) * len(stmt.Rows)
+	rows := make([][2][]tuple.TupleElement, 0, n)
+	var ends []int // end of every chunk
+	start := 0
+	size := 0
+	for _, args := range argsArray {
+		if stmt.NumPlaceholders != len(args) {
+			err = errors.New("Expected " + strconv.FormatInt(int64(stmt.NumPlaceholders), 10) + " arguments, got " + strconv.FormatInt(int64(len(args)), 10))
+			err = rowError(err, len(rows), n)
+			return
+		}
+		for _, row := range stmt.Rows {
+			var parts [2][]tuple.TupleElement
+			err = prepareInsert(stmt, row, args, now, &parts)
+			if err != nil {
+				err = rowError(err, len(rows), n)
+				return
+			}
+			rows = append(rows, parts)
+			size += estimateSize(parts[0]) + estimateSize(parts[1])
+		}
+		if size >= maxBatchBytes || len(rows)-start >= maxBatchRows {
+			ends = append(ends, len(rows))
+			start = len(rows)
+			size = 0
+		}
+	}
+	if start < len(rows) || len(ends) == 0 {
+		ends = append(ends, len(rows))
+	}
+	if stmt.OnConflict == conflictAbort && len(ends) > 1 {
+		// all or nothing
+		err = errors.New("Too many rows for IF NOT EXISTS in one transaction, at most " + strconv.Itoa(ends[0]) + " rows")
+		return
+	}
+	// keys of committed chunks
+	seen := make(map[string]bool)
+	existed := make([]bool, 0, len(rows))
+	start = 0
+	for _, end := range ends {
+		chunk := rows[start:end]
+		tmp, err1 := db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
+			if err = checkSchema(tr, stmt.Schema); err != nil {
+				return
+			}
+			keys, values, err := packRows(tr, stmt.Schema, dict, chunk)
+			if err != nil {
+				return
+			}
+			if stmt.OnConflict == conflictOverwrite {
+				err = setRows(tr, stmt.Schema, keys, values)
+				return
+			}
+			olds, err := getRows(tr, stmt.Schema, keys)
+			if err != nil {
+				return
+			}
+			existed := make([]bool, len(keys))
+			seen2 := make(map[string]bool)
+			var conflicts []string
+			for i, v := range olds {
+				k := string(keys[i])
+				existed[i] = v != nil || seen[k] || seen2[k]
+				if existed[i] {
+					conflicts = append(conflicts, strconv.Itoa(start+i))
+				}
+				seen2[k] = true
+			}
+			if stmt.OnConflict == conflictAbort && conflicts != nil && len(rows) > 1 {
+				err = errors.New("Some rows already exist: " + strings.Join(conflicts, ", "))
+				return
+			}
+			var keys2 []fdb.Key
+			var values2 [][]byte
+			latest := make(map[string][]byte) // values written by this chunk
+			for i := range keys {
+				if stmt.OnConflict == conflictUpdate {
+					k := string(keys[i])
+					old, ok := latest[k]
+					if !ok {
+						old = olds[i]
+					}
+					if old != nil {
+						values[i], err = mergeValue(stmt, old, values[i])
+						if err != nil {
+							return
+						}
+					}
+					latest[k] = values[i]
+				} else if existed[i] {
+					continue
+				}
+				keys2 = append(keys2, keys[i])
+				values2 = append(values2, values[i])
+			}
+			err = setRows(tr, stmt.Schema, keys2, values2)
+			if err != nil {
+				return
+			}
+			// seen is updated after commit, since the closure may be retried
+			ret = chunkResult{existed, seen2}
+			return
+		})
+		if err1 != nil {
+			err = err1
+			if start > 0 {
+				err = errors.New("Partially committed up to row " + strconv.Itoa(start) + ": " + err.Error())
+			}
+			return
+		}
+		if tmp != nil {
+			res := tmp.(chunkResult)
+			existed = append(existed, res.existed...)
+			for k := range res.seen {
+				seen[k] = true
+			}
+		}
+		start = end
+	}
+	if stmt.OnConflict == conflictOverwrite {
+		return
+	}
+	res = make([][]interface{}, len(existed))
+	for i, v := range existed {
+		res[i] = []interface{}{v}
+	}
+	return
+}
+
+// columns given by the insert replace those of the existing row, for ON CONFLICT DO UPDATE
+func mergeValue(stmt *insertStmt, old []byte, value []byte) (res []byte, err error) {
+	a, err := tuple.Unpack(old)
+	if err != nil {
+		return
+	}
+	b, err := tuple.Unpack(value)
+	if err != nil {
+		return
+	}
+	for len(a) < len(b) {
+		a = append(a, nil)
+	}
+	for _, col := range stmt.Schema.Values {
+		if stmt.Given[col.PosCol] {
+			a[col.Pos] = b[col.Pos]
+		}
+	}
+	res = a.Pack()
+	return
+}
+
+type chunkResult struct {
+	existed []bool
+	seen    map[string]bool // keys of the chunk
+}
+
+// limits of one transaction of BatchInsert, well below 10MB and 5 seconds of FoundationDB
+var maxBatchBytes = 4 << 20
+var maxBatchRows = 50000
+
+// approximate packed size
+func estimateSize(values []tuple.TupleElement) (n int) {
+	for _, v := range values {
+		switch v1 := v.(type) {
+		case string:
+			n += len(v1) + 2
+		case []byte:
+			n += len(v1) + 2
+		case symbol:
+			n += 9
+		default:
+			n += 10
+		}
+	}
+	return
+}
+
+// symbols are assigned ids if tr is writable, otherwise looked up and key of unknown symbol is nil
+func packRows(tr fdb.ReadTransaction, schema *TableSchema, dict *symbolDict, rows [][2][]tuple.TupleElement) (keys []fdb.Key, values [][]byte, err error) {
+	keys = make([]fdb.Key, len(rows))
+	values = make([][]byte, len(rows))
+	for i, parts := range rows {
+		if dict != nil {
+			unknown := false
+			for j := range parts {
+				// ids assigned in a failed attempt must not be kept
+				p := make([]tuple.TupleElement, len(parts[j]))
+				copy(p, parts[j])
+				if wtr, ok := tr.(fdb.Transaction); ok {
+					err = dict.assignAll(wtr, p)
+				} else {
+					for k, v := range p {
+						if s, ok := v.(symbol); ok {
+							var id int64
+							if id, err = dict.lookup(tr, string(s)); err != nil {
+								return
+							}
+							p[k] = id
+							unknown = unknown || id < 0
+						}
+					}
+				}
+				if err != nil {
+					return
+				}
+				parts[j] = p
+			}
+			if unknown {
+				continue
+			}
+		}
+		keys[i] = schema.Dir.Pack(tuple.Tuple(parts[0]))
+		values[i] = tuple.Tuple(parts[1]).Pack()
+	}
+	return
+}
+
+// tell which row is wrong if more than one row
+func rowError(err error, i int, n int) error {
+	if n <= 1 {
+		return err
+	}
+	return errors.New("Row " + strconv.Itoa(i) + ": " + err.Error())
+}
+
+func prepareInsert(stmt *insertStmt, row []interface{}, args []interface{}, now int64, parts *[2][]tuple.TupleElement) (err error) {
+	values := row
+	if len(args) > 0 {
+		values = make([]interface{}, len(row))
+		copy(values, row)
+		for i := range values {
+			if p, ok := values[i].(placeholder); ok {
+				values[i], err = validateValue(stmt.Schema.Cols[i], args[int(p)], stmt.Saturate)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+	lens := [2]int{len(stmt.Schema.Keys), stmt.Schema.ValueLen}
+	for i, cols := range [2]([]*TableColDef){stmt.Schema.Keys, stmt.Schema.Values} {
+		parts[i] = make([]tuple.TupleElement, lens[i])
+		for _, col := range cols {
+			v := evalRelativeTime(values[col.PosCol], now)
+			parts[i][col.Pos] = tuple.TupleElement(v)
+		}
+	}
+	return
+}
+
+func executeInsert(db fdb.Transactor, stmt *insertStmt, args []interface{}) (res [][]interface{}, err error) {
+	if stmt.Schema.TblName == "_adj_" {
+		adjCache.clear(stmt.Schema.DbName)
+	}
+	argsArray := [1][]interface{}{args}
+	return BatchInsert(db, stmt, argsArray[:])
+}
+
+func resolveSelect(db fdb.Transactor, dbName string, ast *AstSelect, user ...*User) (stmt selectStmt, err error) {
+	stmt.Schema, err = getTableSchema(db, dbName, ast.Table)
+	schema := stmt.Schema
 	if err != nil {
 		return
 	}
+	if GetPerm(schema.DbName, schema.TblName, user...) == NoPerm {
+		err = errors.New("No permisssion")
+		return
+	}
+	stmt.Where, stmt.NumPlaceholders, err = resolveWhere(stmt.Schema, ast.Where, ast.AllowFiltering != nil)
+	if err != nil {
+		return
+	}
+	for _, branch := range stmt.Where {
+		if branch.Filters != nil && ast.AllowFiltering == nil && (len(branch.Conds) == 0 || branch.Conds[0].Equal == nil) {
+			err = errors.New("Cannot execute this query as it might involve data filtering and thus may have unpredictable performance, restrict the first primary key with '=' or use ALLOW FILTERING")
+			return
+		}
+	}
 	if ast.Limit != nil {
 		stmt.Limit = int(*ast.Limit)
 		if stmt.Limit < 0 {
+			if ast.OrderBy != nil {
+				err = errors.New("Negative LIMIT cannot be used with ORDER BY")
+				return
+			}
 			stmt.Limit = -stmt.Limit
 			stmt.Reverse = true
 		}
 	}
+	if ast.Offset != nil {
+		if *ast.Offset < 0 {
+			err = errors.New("OFFSET must not be negative")
+			return
+		}
+		stmt.Offset = int(*ast.Offset)
+	}
+	if ast.OrderBy != nil {
+		err = resolveOrderBy(&stmt, ast.OrderBy)
+		if err != nil {
+			return
+		}
+	}
+	var items []AstSelectCol
+	var exprs []*selectExpr
+	nplain := 0
+	if ast.Selected.All == nil {
+		items, exprs, nplain, err = resolveSelectExprs(ast.Selected.Cols)
+		if err != nil {
+			return
+		}
+	}
+	if ast.Distinct != nil {
+		err = checkDistinct(ast, items)
+		if err != nil {
+			return
+		}
+	}
+	if ast.LatestBy != nil {
+		err = resolveLatestBy(&stmt, ast, items)
+		if err != nil {
+			return
+		}
+	}
+	for _, col := range items {
+		if col.Ohlcv != nil {
+			err = resolveOhlcv(&stmt, ast, items)
+			if err == nil && ast.Fill != nil {
+				err = resolveFill(&stmt, ast.Fill)
+			}
+			return
+		}
+	}
+	if ast.Join != nil {
+		if ast.Fill != nil {
+			err = errors.New("FILL cannot be used with ASOF JOIN")
+			return
+		}
+		err = resolveAsofJoin(db, dbName, &stmt, ast, items, user...)
+		if err == nil && exprs != nil {
+			stmt.setExprs(exprs)
+		}
+		return
+	}
 	if ast.Selected.All != nil {
+		if ast.GroupBy != nil {
+			err = errors.New("Cannot select * with GROUP BY")
+			return
+		}
 		stmt.Cols = schema.Cols
 		return
 	}
 	used := make([]bool, len(schema.Cols))
-	stmt.Cols = make([]*TableColDef, len(ast.Selected.Cols))
-	stmt.Funcs = make([]*selectFunc, len(ast.Selected.Cols))
-	for j, col := range ast.Selected.Cols {
+	n := len(items)
+	stmt.Cols = make([]*TableColDef, n)
+	stmt.Funcs = make([]*selectFunc, n)
+	if ast.GroupBy != nil {
+		stmt.Aggs = make([]*aggFunc, n)
+	}
+	for j, col := range items {
 		colName := col.Name
-		var funcName *string
-		var params []AstValue
+		fn := col.Func
+		if col.Agg != nil {
+			if stmt.Aggs == nil {
+				stmt.Aggs = make([]*aggFunc, n)
+			}
+			stmt.Aggs[j] = &aggFunc{Name: strings.ToLower(*col.Agg.Name)}
+			if col.Agg.All != nil {
+				if stmt.Aggs[j].Name != "count" && stmt.Aggs[j].Name != "approx_count" {
+					err = errors.New("Only count accepts *")
+					return
+				}
+				continue
+			}
+			if stmt.Aggs[j].Name == "approx_count" {
+				err = errors.New("approx_count only accepts *")
+				return
+			}
+			colName = col.Agg.Col
+			fn = col.Agg.Func
+		}
 		if colName == nil {
-			colName = col.Func.Col
-			funcName = col.Func.Name
-			params = col.Func.Params
+			colName = fn.Col
 		}
-		col, ok := schema.NameMap[*colName]
+		if col.Table != nil && *col.Table != schema.TblName {
+			err = errors.New("Unknown table " + *col.Table)
+			return
+		}
+		col2, ok := schema.NameMap[*colName]
 		if !ok {
 			err = errors.New("Undefined column name " + *colName)
 			return
 		}
-		i := col.PosCol
-		if used[i] {
-			err = errors.New("Duplicate column name " + *colName)
+		// to_timezone(time) is a different view of time
+		if col.Agg == nil && j < nplain && (fn == nil || strings.ToLower(*fn.Name) != "to_timezone") {
+			i := col2.PosCol
+			if used[i] {
+				err = errors.New("Duplicate column name " + *colName)
+				return
+			}
+			used[i] = true
+		}
+		stmt.Cols[j] = col2
+		if col.Name == nil {
+			stmt.Funcs[j], err = resolveSelectFunc(col2, fn)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if stmt.Aggs != nil {
+		err = resolveGroupBy(&stmt, ast.GroupBy)
+		if err != nil {
+			return
+		}
+	}
+	if ast.Fill != nil {
+		err = resolveFill(&stmt, ast.Fill)
+		if err != nil {
 			return
 		}
-		used[i] = true
-		stmt.Cols[j] = col
-		if funcName != nil {
-			tmp := strings.ToLower(*funcName)
-			funcName = &tmp
-			if tmp == "adj" {
-				tmp = strings.ToLower(col.Name)
-				if strings.Contains(tmp, "qty") || strings.Contains(tmp, "vol") || strings.Contains(tmp, "size") {
-					tmp = "adj_vol"
-				} else {
-					tmp = "adj_px"
+	}
+	if ast.Distinct != nil {
+		err = resolveDistinct(&stmt)
+		if err != nil {
+			return
+		}
+	}
+	if stmt.Aggs != nil {
+		err = resolveCount(&stmt)
+		if err != nil {
+			return
+		}
+	}
+	err = getAdjTuples(&stmt)
+	if err == nil && exprs != nil {
+		stmt.setExprs(exprs)
+	}
+	return
+}
+
+func resolveOrderBy(stmt *selectStmt, orderBy *AstOrderBy) (err error) {
+	col, ok := stmt.Schema.NameMap[*orderBy.Col]
+	if !ok {
+		return errors.New("Undefined column name " + *orderBy.Col)
+	}
+	if !col.IsKey {
+		return errors.New("Invalid column " + col.Name + " in ORDER BY, only primary key can be used")
+	}
+	// rows are in primary key order, the keys before col must be fixed to one value by all branches
+	for i := 0; i < int(col.Pos); i++ {
+		ok := stmt.Where != nil
+		for _, branch := range stmt.Where {
+			if i >= len(branch.Conds) || branch.Conds[i].Equal == nil {
+				ok = false
+			} else if !reflect.DeepEqual(branch.Conds[i].Equal, stmt.Where[0].Conds[i].Equal) {
+				return errors.New("ORDER BY " + col.Name + " requires " + stmt.Schema.Keys[i].Name + " to be restricted by one value")
+			}
+		}
+		if !ok {
+			return errors.New("ORDER BY " + col.Name + " requires " + stmt.Schema.Keys[i].Name + " to be restricted by '='")
+		}
+	}
+	stmt.Reverse = orderBy.Direction != nil && *orderBy.Direction == "DESC"
+	return
+}
+
+func resolveSelectFunc(col *TableColDef, fn *AstSelectFunc) (ret *selectFunc, err error) {
+	name := strings.ToLower(*fn.Name)
+	if name == "adj" {
+		tmp := strings.ToLower(col.Name)
+		if strings.Contains(tmp, "qty") || strings.Contains(tmp, "vol") || strings.Contains(tmp, "size") {
+			name = "adj_vol"
+		} else {
+			name = "adj_px"
+		}
+	}
+	if name == "adj_vol" || name == "adj_px" {
+		switch col.Type {
+		case Decimal, Blob, Symbol:
+			err = errors.New("adj not supported on column " + col.Name + " of " + col.Type.Name())
+			return
+		}
+		if fn.Params != nil && (len(fn.Params) > 1 || fn.Params[0].Boolean == nil) {
+			err = errors.New("adj only accept one optional bool params")
+			return
+		}
+	}
+	ret = &selectFunc{Name: name, Params: fn.Params}
+	if name == "to_timezone" {
+		if col.Type != Timestamp {
+			err = errors.New("to_timezone not supported on column " + col.Name + " of " + col.Type.Name())
+			return
+		}
+		if len(fn.Params) != 1 || fn.Params[0].String == nil {
+			err = errors.New("to_timezone only accept one time zone name")
+			return
+		}
+		ret.Loc, err = time.LoadLocation(*fn.Params[0].String)
+		if err != nil {
+			err = errors.New("Unknown time zone '" + *fn.Params[0].String + "'")
+		}
+	}
+	return
+}
+
+type asofJoin struct {
+	Schema *TableSchema
+	Cols   []*TableColDef // len(selectStmt.Cols), nil if from the left table
+}
+
+func resolveAsofJoin(db fdb.Transactor, dbName string, stmt *selectStmt, ast *AstSelect, items []AstSelectCol, user ...*User) (err error) {
+	if ast.GroupBy != nil {
+		return errors.New("GROUP BY not supported with ASOF JOIN")
+	}
+	join := &asofJoin{}
+	join.Schema, err = getTableSchema(db, dbName, ast.Join.Table)
+	if err != nil {
+		return
+	}
+	if GetPerm(join.Schema.DbName, join.Schema.TblName, user...) == NoPerm {
+		return errors.New("No permisssion")
+	}
+	left := stmt.Schema
+	right := join.Schema
+	n := len(ast.Join.On)
+	if len(left.Keys) != n+1 || len(right.Keys) != n+1 {
+		return errors.New("ASOF JOIN must be ON all primary keys but the last one of both tables")
+	}
+	for i, name := range ast.Join.On {
+		if left.Keys[i].Name != name || right.Keys[i].Name != name || left.Keys[i].Type != right.Keys[i].Type {
+			return errors.New("ON column " + name + " must be primary key #" + strconv.Itoa(i+1) + " of the same type in both tables")
+		}
+		if left.Keys[i].Type == Symbol && left.DbName != right.DbName {
+			return errors.New("ON column " + name + " of type Symbol must be in tables of the same database")
+		}
+	}
+	if left.Keys[n].Type != Timestamp || right.Keys[n].Type != Timestamp {
+		return errors.New("The last key of both tables must be timestamp for ASOF JOIN")
+	}
+	stmt.Join = join
+	if ast.Selected.All != nil {
+		stmt.Cols = append([]*TableColDef{}, left.Cols...)
+		join.Cols = make([]*TableColDef, len(stmt.Cols))
+		for _, col := range right.Values {
+			stmt.Cols = append(stmt.Cols, nil)
+			join.Cols = append(join.Cols, col)
+		}
+		return
+	}
+	m := len(items)
+	stmt.Cols = make([]*TableColDef, m)
+	stmt.Funcs = make([]*selectFunc, m)
+	join.Cols = make([]*TableColDef, m)
+	for j, col := range items {
+		if col.Agg != nil {
+			return errors.New("Aggregate not supported with ASOF JOIN")
+		}
+		if col.Func != nil {
+			col2, ok := left.NameMap[*col.Func.Col]
+			if !ok {
+				return errors.New("Undefined column name " + *col.Func.Col + " in table " + left.TblName)
+			}
+			stmt.Cols[j] = col2
+			stmt.Funcs[j], err = resolveSelectFunc(col2, col.Func)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		name := *col.Name
+		col1, ok1 := left.NameMap[name]
+		col2, ok2 := right.NameMap[name]
+		if col.Table != nil {
+			if *col.Table == left.TblName {
+				ok2 = false
+			} else if *col.Table == right.TblName {
+				ok1 = false
+			} else {
+				return errors.New("Unknown table " + *col.Table)
+			}
+		}
+		if ok1 && ok2 && !col1.IsKey {
+			return errors.New("Ambiguous column name " + name)
+		}
+		if ok1 {
+			stmt.Cols[j] = col1
+		} else if ok2 {
+			join.Cols[j] = col2
+		} else {
+			return errors.New("Undefined column name " + name)
+		}
+	}
+	err = getAdjTuples(stmt)
+	return
+}
+
+func executeAsofJoin(db fdb.Transactor, stmt *selectStmt, recs [][2]tuple.Tuple) (res [][]interface{}, err error) {
+	if len(recs) == 0 {
+		return
+	}
+	join := stmt.Join
+	n := len(join.Schema.Keys) - 1
+	matched := make([][2]tuple.Tuple, len(recs))
+	_, err = db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
+		for i := 0; i < len(recs); {
+			prefix := recs[i][0][:n]
+			packed := string(prefix.Pack())
+			j := i + 1
+			for j < len(recs) && string(recs[j][0][:n].Pack()) == packed {
+				j++
+			}
+			first, last := i, j-1
+			if stmt.Reverse {
+				first, last = last, first
+			}
+			sub := join.Schema.Dir.Sub(prefix...)
+			begin, _ := sub.FDBRangeKeys()
+			// the latest row at or before the first left row
+			kr := fdb.KeyRange{Begin: begin, End: fdb.Key(append(sub.Sub(recs[first][0][n]).Bytes(), 0x1))}
+			var kvs []fdb.KeyValue
+			kvs, err = getRange(tr, join.Schema, kr, fdb.RangeOptions{Limit: 1, Reverse: true})
+			if err != nil {
+				return
+			}
+			if len(kvs) > 0 {
+				begin = kvs[0].Key
+			}
+			kr = fdb.KeyRange{Begin: begin, End: fdb.Key(append(sub.Sub(recs[last][0][n]).Bytes(), 0x1))}
+			kvs, err = getRange(tr, join.Schema, kr, fdb.RangeOptions{})
+			if err != nil {
+				return
+			}
+			rights := make([][2]tuple.Tuple, len(kvs))
+			tms := make([]int64, len(kvs))
+			for k, kv := range kvs {
+				rights[k], err = unpackRecord(join.Schema, kv)
+				if err != nil {
+					return
+				}
+				tms[k], _ = getTimestamp(rights[k][0][n])
+			}
+			p := -1
+			for k := i; k < j; k++ {
+				k2 := k
+				if stmt.Reverse {
+					k2 = i + j - 1 - k
+				}
+				tm, _ := getTimestamp(recs[k2][0][n])
+				for p+1 < len(rights) && tms[p+1] <= tm {
+					p++
 				}
-				funcName = &tmp
-			}
-			if tmp == "adj_vol" || tmp == "adj_px" {
-				if params != nil && (len(params) > 1 || params[0].Boolean == nil) {
-					err = errors.New("adj only accept one optional bool params")
-					return
+				if p >= 0 {
+					matched[k2] = rights[p]
 				}
 			}
-			stmt.Funcs[j] = &selectFunc{*funcName, params}
+			i = j
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	res = make([][]interface{}, len(recs))
+	for i, rec := range recs {
+		row := make([]interface{}, len(stmt.Cols))
+		res[i] = row
+		for j, col := range stmt.Cols {
+			if col != nil {
+				row[j] = getColValue(col, rec)
+			} else if matched[i][0] != nil {
+				row[j] = getColValue(join.Cols[j], matched[i])
+			}
 		}
 	}
-	err = getAdjTuples(&stmt)
 	return
 }
 
 type whereStmt interface {
 	GetNumPlaceholders() int
-	GetConds() []condition
+	GetWhere() []whereBranch
 	GetSchema() *TableSchema
 }
 
+// one conjunction of the where clause in disjunctive normal form
+type whereBranch struct {
+	Conds   []condition // <= len(Schema.Keys)
+	Filters []filter    // residual predicates evaluated while scanning
+}
+
 type adjTuple struct {
 	Pos      int
 	Adj      int // 1: px, 2: vol
@@ -431,25 +1503,36 @@ type adjTuple struct {
 type selectFunc struct {
 	Name   string
 	Params []AstValue
+	Loc    *time.Location // of to_timezone
 }
 
 type selectStmt struct {
 	Schema          *TableSchema
-	Conds           []condition    // <= len(Schema.Keys)
-	Cols            []*TableColDef // nil or len(ast.Selected.Cols)
+	Where           []whereBranch  // nil if no where clause
+	Cols            []*TableColDef // nil or len(ast.Selected.Cols) and leaves of Exprs
 	Funcs           []*selectFunc
 	NumPlaceholders int
 	Limit           int
+	Offset          int
 	Reverse         bool
 	Adjs            []adjTuple
+	Aggs            []*aggFunc // nil if not aggregated, otherwise len(Cols)
+	GroupBy         []*TableColDef
+	Bucket          *timeBucket
+	Latest          int    // number of leading keys of LATEST BY
+	Distinct        int    // number of leading keys of SELECT DISTINCT
+	Count           string // count or approx_count if count(*) is the only aggregate
+	Fill            *fillOption
+	Join            *asofJoin
+	Exprs           []*selectExpr // nil if no expression, otherwise len(ast.Selected.Cols)
 }
 
 func (self *selectStmt) GetNumPlaceholders() int {
 	return self.NumPlaceholders
 }
 
-func (self *selectStmt) GetConds() []condition {
-	return self.Conds
+func (self *selectStmt) GetWhere() []whereBranch {
+	return self.Where
 }
 
 func (self *selectStmt) GetSchema() *TableSchema {
@@ -471,35 +1554,70 @@ func resolveInsert(db fdb.Transactor, dbName string, ast *AstInsert, user ...*Us
 			ast.Cols = append(ast.Cols, col.Name)
 		}
 	}
-	if len(ast.Cols) != len(ast.Values) {
-		err = errors.New("Unmatched column names/values")
-		return
+	stmt.Saturate = ast.Saturate != nil
+	rows := make([][]AstValue, 1+len(ast.Rows))
+	rows[0] = ast.Values
+	for i, row := range ast.Rows {
+		rows[i+1] = row.Values
 	}
-	stmt.Values = make([]interface{}, len(schema.Cols))
-	for j, colName := range ast.Cols {
-		col, ok := schema.NameMap[colName]
-		if !ok {
-			err = errors.New("Undefined column name " + colName)
+	stmt.Rows = make([][]interface{}, len(rows))
+	for r, astValues := range rows {
+		if len(ast.Cols) != len(astValues) {
+			err = errors.New("Unmatched column names/values")
 			return
 		}
-		i := col.PosCol
-		if stmt.Values[i] != nil {
-			err = errors.New("Duplicate column name " + colName)
-			return
+		values := make([]interface{}, len(schema.Cols))
+		given := make([]bool, len(schema.Cols))
+		for j, colName := range ast.Cols {
+			col, ok := schema.NameMap[colName]
+			if !ok {
+				err = errors.New("Undefined column name " + colName)
+				return
+			}
+			i := col.PosCol
+			if given[i] {
+				err = errors.New("Duplicate column name " + colName)
+				return
+			}
+			given[i] = true
+			if astValues[j].Placeholder != nil {
+				values[i] = placeholder(stmt.NumPlaceholders)
+				stmt.NumPlaceholders++
+				continue
+			}
+			values[i], err = validateValue(col, astValues[j].Value(), stmt.Saturate)
+			if err != nil {
+				err = rowError(err, r, len(rows))
+				return
+			}
 		}
-		if ast.Values[j].Placeholder != nil {
-			stmt.Values[i] = placeholder(stmt.NumPlaceholders)
-			stmt.NumPlaceholders++
-			continue
+		for _, col := range schema.Values {
+			if !given[col.PosCol] {
+				values[col.PosCol] = col.Default
+				if col.NotNull && col.Default == nil {
+					err = rowError(errors.New("Column "+col.Name+" cannot be null"), r, len(rows))
+					return
+				}
+			}
 		}
-		stmt.Values[i], err = validateValue(col, ast.Values[j].Value())
-		if err != nil {
+		stmt.Rows[r] = values
+		stmt.Given = given
+	}
+	if ast.IfNotExists != nil {
+		if ast.OnConflict != nil {
+			err = errors.New("IF NOT EXISTS cannot be used with ON CONFLICT")
 			return
 		}
+		stmt.OnConflict = conflictAbort
+	} else if ast.OnConflict != nil {
+		stmt.OnConflict = conflictNothing
+		if *ast.OnConflict == "UPDATE" {
+			stmt.OnConflict = conflictUpdate
+		}
 	}
 	var missed []string
 	for _, col := range schema.Keys {
-		if stmt.Values[col.PosCol] == nil {
+		if stmt.Rows[0][col.PosCol] == nil {
 			missed = append(missed, col.Name)
 		}
 	}
@@ -510,10 +1628,20 @@ func resolveInsert(db fdb.Transactor, dbName string, ast *AstInsert, user ...*Us
 	return
 }
 
+const (
+	conflictOverwrite = iota
+	conflictNothing   // ON CONFLICT DO NOTHING, skip existing rows
+	conflictUpdate    // ON CONFLICT DO UPDATE, overwrite given columns of existing rows
+	conflictAbort     // IF NOT EXISTS, write nothing and fail if any row of a batch exists
+)
+
 type insertStmt struct {
 	Schema          *TableSchema
-	Values          []interface{} // len(Schema.Cols)
+	Rows            [][]interface{} // each of len(Schema.Cols)
+	Given           []bool          // columns listed by the insert, of len(Schema.Cols)
 	NumPlaceholders int
+	OnConflict      int
+	Saturate        bool
 }
 
 func resolveDelete(db fdb.Transactor, dbName string, ast *AstDelete, user ...*User) (stmt deleteStmt, err error) {
@@ -525,7 +1653,16 @@ func resolveDelete(db fdb.Transactor, dbName string, ast *AstDelete, user ...*Us
 		err = errors.New("No permisssion")
 		return
 	}
-	stmt.Conds, stmt.NumPlaceholders, err = resolveWhere(stmt.Schema, ast.Where)
+	stmt.Where, stmt.NumPlaceholders, err = resolveWhere(stmt.Schema, ast.Where, false)
+	if err != nil {
+		return
+	}
+	for _, branch := range stmt.Where {
+		if branch.Filters != nil {
+			err = errors.New("Invalid column " + branch.Filters[0].Col.Name + " in where clause, only primary key can be used")
+			return
+		}
+	}
 	return
 }
 
@@ -539,12 +1676,143 @@ func AlterTable(db fdb.Transactor, dbName string, ast *AstAlterTable, user ...*U
 		err = errors.New("No permisssion")
 		return
 	}
-	return RenameTable(db, schema, ast.AlterTableType.Rename.ColOldNewName, ast.AlterTableType.Rename.NewTableName)
+	alter := ast.AlterTableType
+	if alter.Add != nil {
+		col, err1 := newTableColDef(*alter.Add.Name, string(*alter.Add.Type), alter.Add.Params)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = resolveColConstraints(col, alter.Add.Constraints)
+		if err != nil {
+			return
+		}
+		if col.NotNull && col.Default == nil {
+			err = errors.New("NOT NULL column " + col.Name + " requires a DEFAULT")
+			return
+		}
+		return AddColumn(db, schema, col)
+	}
+	if alter.Drop != nil {
+		return DropColumn(db, schema, *alter.Drop)
+	}
+	if alter.Alter != nil {
+		if alter.Alter.Params != nil {
+			err = errors.New("Cannot change precision or scale of column " + *alter.Alter.Name)
+			return
+		}
+		return AlterColumnType(db, schema, *alter.Alter.Name, parseDataType(string(*alter.Alter.Type)))
+	}
+	return RenameTable(db, schema, alter.Rename.ColOldNewName, alter.Rename.NewTableName)
+}
+
+func resolveUpdate(db fdb.Transactor, dbName string, ast *AstUpdate, user ...*User) (stmt updateStmt, err error) {
+	stmt.Schema, err = getTableSchema(db, dbName, ast.Table)
+	if err != nil {
+		return
+	}
+	schema := stmt.Schema
+	if GetPerm(schema.DbName, schema.TblName, user...) != WritablePerm {
+		err = errors.New("No permisssion")
+		return
+	}
+	stmt.Saturate = ast.Saturate != nil
+	stmt.Cols = make([]*TableColDef, len(ast.Set))
+	stmt.Values = make([]interface{}, len(ast.Set))
+	for i, set := range ast.Set {
+		col, ok := schema.NameMap[*set.Col]
+		if !ok {
+			err = errors.New("Undefined column name " + *set.Col)
+			return
+		}
+		if col.IsKey {
+			err = errors.New("PRIMARY KEY part " + col.Name + " found in SET part")
+			return
+		}
+		for _, col2 := range stmt.Cols[:i] {
+			if col2 == col {
+				err = errors.New("Duplicate column name " + col.Name)
+				return
+			}
+		}
+		stmt.Cols[i] = col
+		if set.Value.Placeholder != nil {
+			stmt.Values[i] = placeholder(stmt.NumPlaceholders)
+			stmt.NumPlaceholders++
+			continue
+		}
+		stmt.Values[i], err = validateValue(col, set.Value.Value(), stmt.Saturate)
+		if err != nil {
+			return
+		}
+	}
+	stmt.Where, stmt.NumWherePlaceholders, err = resolveWhere(schema, ast.Where, false)
+	if err != nil {
+		return
+	}
+	stmt.NumPlaceholders += stmt.NumWherePlaceholders
+	for _, branch := range stmt.Where {
+		if branch.Filters != nil {
+			err = errors.New("Invalid column " + branch.Filters[0].Col.Name + " in where clause, only primary key can be used")
+			return
+		}
+	}
+	return
+}
+
+type updateStmt struct {
+	Schema               *TableSchema
+	Cols                 []*TableColDef
+	Values               []interface{} // len(Cols)
+	Where                []whereBranch
+	NumPlaceholders      int
+	NumWherePlaceholders int // placeholders of set part come first
+	Saturate             bool
+}
+
+func (self *updateStmt) GetNumPlaceholders() int {
+	return self.NumWherePlaceholders
+}
+
+func (self *updateStmt) GetWhere() []whereBranch {
+	return self.Where
+}
+
+func (self *updateStmt) GetSchema() *TableSchema {
+	return self.Schema
+}
+
+func resolveColConstraints(col *TableColDef, constraints []AstColConstraint) (err error) {
+	for _, c := range constraints {
+		if c.NotNull != nil {
+			col.NotNull = true
+		} else if c.Null != nil {
+			col.NotNull = false
+		} else {
+			if c.Default.Placeholder != nil {
+				err = errors.New("Placeholder not allowed in DEFAULT")
+				return
+			}
+			if col.Type == Symbol {
+				err = errors.New("DEFAULT not allowed on column " + col.Name + " of type Symbol")
+				return
+			}
+			if c.Default.Time != nil && c.Default.Time.Now != nil {
+				err = errors.New("NOW() not allowed in DEFAULT")
+				return
+			}
+			col.Default, err = validateValue(col, c.Default.Value(), false)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
 }
 
 type deleteStmt struct {
 	Schema          *TableSchema
-	Conds           []condition // <= len(Schema.Keys)
+	Where           []whereBranch
 	NumPlaceholders int
 }
 
@@ -552,8 +1820,8 @@ func (self *deleteStmt) GetNumPlaceholders() int {
 	return self.NumPlaceholders
 }
 
-func (self *deleteStmt) GetConds() []condition {
-	return self.Conds
+func (self *deleteStmt) GetWhere() []whereBranch {
+	return self.Where
 }
 
 func (self *deleteStmt) GetSchema() *TableSchema {
@@ -576,36 +1844,233 @@ func (self *condition) IsRange() bool {
 	return self.End[0] != nil || self.Start[0] != nil
 }
 
-func resolveWhere(schema *TableSchema, where *AstExpression) (conds []condition, numPlaceholder int, err error) {
+type filter struct {
+	Col   *TableColDef
+	Op    string
+	Value interface{}
+}
+
+func (self *filter) match(rec [2]tuple.Tuple) bool {
+	v := getColValue(self.Col, rec)
+	switch self.Op {
+	case "is null":
+		return v == nil
+	case "is not null":
+		return v != nil
+	}
+	if v == nil || self.Value == nil {
+		return false
+	}
+	if self.Op == "in" {
+		for _, v2 := range self.Value.([]interface{}) {
+			if compareValue(v, v2) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	c := compareValue(v, self.Value)
+	switch self.Op {
+	case "=":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func matchFilters(filters []filter, rec [2]tuple.Tuple) bool {
+	for i := range filters {
+		if !filters[i].match(rec) {
+			return false
+		}
+	}
+	return true
+}
+
+func validateFilterArgs(origFilters []filter, args []interface{}) (filters []filter, err error) {
+	filters = origFilters
+	if len(args) == 0 || filters == nil {
+		return
+	}
+	filters = make([]filter, len(origFilters))
+	copy(filters, origFilters)
+	for i := range filters {
+		f := &filters[i]
+		if p, ok := f.Value.(placeholder); ok {
+			f.Value, err = validateOperand(f.Col, args[int(p)])
+			if err != nil {
+				return
+			}
+		} else if values, ok := f.Value.([]interface{}); ok {
+			f.Value = make([]interface{}, len(values))
+			for j, v := range values {
+				if p, ok := v.(placeholder); ok {
+					v, err = validateOperand(f.Col, args[int(p)])
+					if err != nil {
+						return
+					}
+				}
+				f.Value.([]interface{})[j] = v
+			}
+		}
+	}
+	return
+}
+
+const maxWhereBranches = 10000
+
+func resolveWhere(schema *TableSchema, where *AstExpression, allowFiltering bool) (branches []whereBranch, numPlaceholder int, err error) {
 	if where == nil {
 		return
 	}
-	conds = make([]condition, len(schema.Keys))
-	for _, cond := range where.And {
-		col, ok := schema.NameMap[*cond.LHS]
-		if !ok {
-			err = errors.New("Undefined column name " + *cond.LHS)
+	terms, err := resolveExpression(schema, where, &numPlaceholder)
+	if err != nil {
+		return
+	}
+	branches = make([]whereBranch, len(terms))
+	for i, term := range terms {
+		branches[i].Conds, branches[i].Filters, err = resolveConjunction(schema, term, allowFiltering)
+		if err != nil {
 			return
 		}
-		if !col.IsKey {
-			err = errors.New("Invalid column " + col.Name + " in where clause, only primary key can be used")
+	}
+	return
+}
+
+// expand expression into disjunctive normal form, IN on primary key expands into one term per value
+func resolveExpression(schema *TableSchema, expr *AstExpression, numPlaceholder *int) (terms [][]filter, err error) {
+	terms = [][]filter{nil}
+	for i := range expr.And {
+		var terms2 [][]filter
+		terms2, err = resolveCondition(schema, &expr.And[i], numPlaceholder)
+		if err != nil {
 			return
 		}
-		op := *cond.Operator
-		if col.Type == Boolean && op != "=" {
-			err = errors.New("Invalid operator (" + *cond.Operator + ") for \"" + col.Name + "\" of type Boolean")
+		if len(terms)*len(terms2) > maxWhereBranches {
+			err = errors.New("Too many key ranges in where clause, at most " + strconv.Itoa(maxWhereBranches) + " allowed")
 			return
 		}
-		var rhs interface{}
-		if cond.RHS.Placeholder != nil {
-			rhs = placeholder(numPlaceholder)
-			numPlaceholder++
-		} else {
-			rhs, err = validateValue(col, cond.RHS.Value())
+		product := make([][]filter, 0, len(terms)*len(terms2))
+		for _, a := range terms {
+			for _, b := range terms2 {
+				product = append(product, append(append([]filter{}, a...), b...))
+			}
+		}
+		terms = product
+	}
+	for i := range expr.Or {
+		var terms2 [][]filter
+		terms2, err = resolveExpression(schema, &expr.Or[i], numPlaceholder)
+		if err != nil {
+			return
+		}
+		terms = append(terms, terms2...)
+		if len(terms) > maxWhereBranches {
+			err = errors.New("Too many key ranges in where clause, at most " + strconv.Itoa(maxWhereBranches) + " allowed")
+			return
+		}
+	}
+	return
+}
+
+func resolveCondition(schema *TableSchema, cond *AstCondition, numPlaceholder *int) (terms [][]filter, err error) {
+	if cond.Group != nil {
+		return resolveExpression(schema, cond.Group, numPlaceholder)
+	}
+	col, ok := schema.NameMap[*cond.LHS]
+	if !ok {
+		err = errors.New("Undefined column name " + *cond.LHS)
+		return
+	}
+	value := func(v *AstValue) (ret interface{}, err error) {
+		if v.Placeholder != nil {
+			ret = placeholder(*numPlaceholder)
+			*numPlaceholder++
+			return
+		}
+		return validateOperand(col, v.Value())
+	}
+	if cond.IsNull != nil {
+		if col.IsKey {
+			err = errors.New("Invalid IS NULL on primary key " + col.Name)
+			return
+		}
+		op := "is null"
+		if *cond.IsNull != "NULL" {
+			op = "is not null"
+		}
+		terms = [][]filter{{{col, op, nil}}}
+		return
+	}
+	if cond.In != nil {
+		values := make([]interface{}, len(cond.In))
+		for i := range cond.In {
+			values[i], err = value(&cond.In[i])
 			if err != nil {
 				return
 			}
 		}
+		if !col.IsKey {
+			terms = [][]filter{{{col, "in", values}}}
+			return
+		}
+		for _, v := range values {
+			terms = append(terms, []filter{{col, "=", v}})
+		}
+		return
+	}
+	if cond.Between != nil {
+		if col.Type == Boolean || col.Type == Symbol {
+			err = errors.New("Invalid operator (BETWEEN) for \"" + col.Name + "\" of type " + col.Type.Name())
+			return
+		}
+		var lo, hi interface{}
+		if lo, err = value(&cond.Between[0]); err != nil {
+			return
+		}
+		if hi, err = value(&cond.Between[1]); err != nil {
+			return
+		}
+		terms = [][]filter{{{col, ">=", lo}, {col, "<=", hi}}}
+		return
+	}
+	op := *cond.Operator
+	if (col.Type == Boolean || col.Type == Symbol) && op != "=" {
+		err = errors.New("Invalid operator (" + *cond.Operator + ") for \"" + col.Name + "\" of type " + col.Type.Name())
+		return
+	}
+	rhs, err := value(cond.RHS)
+	if err != nil {
+		return
+	}
+	terms = [][]filter{{{col, op, rhs}}}
+	return
+}
+
+func resolveConjunction(schema *TableSchema, term []filter, allowFiltering bool) (conds []condition, filters []filter, err error) {
+	conds = make([]condition, len(schema.Keys))
+	var keyFilters [][]filter
+	if allowFiltering {
+		keyFilters = make([][]filter, len(schema.Keys))
+	}
+	for _, f := range term {
+		col := f.Col
+		op := f.Op
+		rhs := f.Value
+		if !col.IsKey {
+			filters = append(filters, f)
+			continue
+		}
+		if keyFilters != nil {
+			keyFilters[col.Pos] = append(keyFilters[col.Pos], f)
+		}
 		if conds[col.Pos].Equal != nil {
 			err = errors.New(col.Name + " cannot be restricted by more than one relation if it includes an Equal")
 			return
@@ -653,8 +2118,13 @@ func resolveWhere(schema *TableSchema, where *AstExpression) (conds []condition,
 		isEmpty := conds[i].IsEmpty()
 		if !isEmpty {
 			if hasEmpty || hasRange {
-				err = errors.New("Cannot execute this query as it might involve data filtering and thus may have unpredictable performance")
-				return
+				if keyFilters == nil {
+					err = errors.New("Cannot execute this query as it might involve data filtering and thus may have unpredictable performance")
+					return
+				}
+				// not usable for the key range, evaluate while scanning instead
+				filters = append(filters, keyFilters[i]...)
+				continue
 			}
 			n++
 		} else {
@@ -664,7 +2134,11 @@ func resolveWhere(schema *TableSchema, where *AstExpression) (conds []condition,
 			hasRange = true
 		}
 	}
-	conds = conds[:n]
+	if n > 0 {
+		conds = conds[:n]
+	} else {
+		conds = nil
+	}
 	return
 }
 
@@ -697,7 +2171,32 @@ func getFloat(v interface{}) (ret float64, ok bool) {
 	return
 }
 
-func validateValue(col *TableColDef, v interface{}) (ret interface{}, err error) {
+var intRanges = map[DataType][2]int64{
+	TinyInt:  {math.MinInt8, math.MaxInt8},
+	SmallInt: {math.MinInt16, math.MaxInt16},
+	Int:      {math.MinInt32, math.MaxInt32},
+}
+
+// value compared with col in where clause, integer out of range of col is kept as is
+// since it compares correctly with all values of col, while clamping would not
+func validateOperand(col *TableColDef, v interface{}) (ret interface{}, err error) {
+	if _, ok := intRanges[col.Type]; ok {
+		if v1, ok := getInt(v); ok {
+			ret = v1
+			return
+		}
+	}
+	return validateValue(col, v, false)
+}
+
+// out of range integer is clamped if saturate, otherwise rejected
+func validateValue(col *TableColDef, v interface{}, saturate bool) (ret interface{}, err error) {
+	if v == nil {
+		if col.IsKey || col.NotNull {
+			err = errors.New("Column " + col.Name + " cannot be null")
+		}
+		return
+	}
 	switch col.Type {
 	case TinyInt, SmallInt, Int, BigInt:
 		var v1 int64
@@ -706,24 +2205,15 @@ func validateValue(col *TableColDef, v interface{}) (ret interface{}, err error)
 		} else {
 			goto hasError
 		}
-		switch col.Type {
-		case TinyInt:
-			if v1 > math.MaxInt8 {
-				v1 = math.MaxInt8
-			} else if v1 < math.MinInt8 {
-				v1 = math.MinInt8
-			}
-		case SmallInt:
-			if v1 > math.MaxInt16 {
-				v1 = math.MaxInt16
-			} else if v1 < math.MinInt16 {
-				v1 = math.MinInt16
+		if r, ok := intRanges[col.Type]; ok && (v1 < r[0] || v1 > r[1]) {
+			if !saturate {
+				err = errors.New("Value " + fmt.Sprint(v) + " out of range for \"" + col.Name + "\" of " + col.Type.Name())
+				return
 			}
-		case Int:
-			if v1 > math.MaxInt32 {
-				v1 = math.MaxInt32
-			} else if v1 < math.MinInt32 {
-				v1 = math.MinInt32
+			if v1 < r[0] {
+				v1 = r[0]
+			} else {
+				v1 = r[1]
 			}
 		}
 		ret = v1
@@ -759,6 +2249,13 @@ func validateValue(col *TableColDef, v interface{}) (ret interface{}, err error)
 		case int:
 			ret = tuple.Tuple{v.(int), 0}
 			return
+		case time.Time:
+			v1 := v.(time.Time)
+			ret = tuple.Tuple{v1.Unix(), int(v1.Nanosecond())}
+			return
+		case relativeTime:
+			ret = v
+			return
 		case []interface{}:
 			v1 := v.([]interface{})
 			if len(v1) == 2 {
@@ -783,6 +2280,41 @@ func validateValue(col *TableColDef, v interface{}) (ret interface{}, err error)
 			goto hasError
 		}
 		ret = v1
+	case Decimal:
+		var str string
+		switch v1 := v.(type) {
+		case string:
+			str = v1
+		case float64:
+			str = strconv.FormatFloat(v1, 'f', -1, 64)
+		default:
+			v2, ok := getInt(v)
+			if !ok {
+				goto hasError
+			}
+			str = strconv.FormatInt(v2, 10)
+		}
+		v1, err1 := parseDecimal(str, col.Precision, col.Scale)
+		if err1 != nil {
+			err = errors.New("Invalid value (" + fmt.Sprint(v) + ") for \"" + col.Name + "\" of Decimal(" + strconv.Itoa(int(col.Precision)) + "," + strconv.Itoa(int(col.Scale)) + ")")
+			return
+		}
+		ret = v1
+	case Blob:
+		switch v1 := v.(type) {
+		case []byte:
+			ret = v1
+		case string:
+			ret = []byte(v1)
+		default:
+			goto hasError
+		}
+	case Symbol:
+		v1, ok := v.(string)
+		if !ok {
+			goto hasError
+		}
+		ret = symbol(v1)
 	}
 	return
 hasError:
@@ -810,19 +2342,19 @@ func validateConditionArgs(schema *TableSchema, origConds []condition, args []in
 		cond := &conds[i]
 		col := schema.Keys[i]
 		if p, ok := cond.Equal.(placeholder); ok {
-			cond.Equal, err = validateValue(col, args[int(p)])
+			cond.Equal, err = validateOperand(col, args[int(p)])
 			if err != nil {
 				return
 			}
 		}
 		if p, ok := cond.Start[0].(placeholder); ok {
-			cond.Start[0], err = validateValue(col, args[int(p)])
+			cond.Start[0], err = validateOperand(col, args[int(p)])
 			if err != nil {
 				return
 			}
 		}
 		if p, ok := cond.End[0].(placeholder); ok {
-			cond.End[0], err = validateValue(col, args[int(p)])
+			cond.End[0], err = validateOperand(col, args[int(p)])
 			if err != nil {
 				return
 			}
@@ -835,6 +2367,13 @@ func getAdjTuples(stmt *selectStmt) (err error) {
 	var adjs []adjTuple
 	nbackward := 0
 	nforward := 0
+	plain := make(map[uint32]bool)
+	for i, col := range stmt.Cols {
+		if col != nil && !col.IsKey && stmt.Funcs[i] == nil {
+			plain[col.Pos] = true
+		}
+	}
+	adjusted := make(map[uint32]bool)
 	for i, sfunc := range stmt.Funcs {
 		if sfunc == nil {
 			continue
@@ -857,7 +2396,14 @@ func getAdjTuples(stmt *selectStmt) (err error) {
 		}
 		stmt.Funcs[i] = nil
 		col := stmt.Cols[i]
-		if !col.IsKey {
+		if col.IsKey {
+			continue
+		}
+		if plain[col.Pos] {
+			return errors.New("Column " + col.Name + " cannot be selected both with and without adj")
+		}
+		if !adjusted[col.Pos] {
+			adjusted[col.Pos] = true
 			adjs = append(adjs, adjTuple{int(col.Pos), j, backward})
 		}
 	}
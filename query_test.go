@@ -1,8 +1,11 @@
 package opentick
 
 import (
+	"fmt"
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -158,6 +161,552 @@ func Test_Query(t *testing.T) {
 	Execute(db, "", "drop table test.test", nil)
 }
 
+func Test_Filter(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for i := 0; i < 10; i++ {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?, ?)", []interface{}{1 + i%2, i, 10. + float64(i), 100 * i})
+		assert.Equal(t, nil, err)
+	}
+	ret, err := Execute(db, "test", "select time, qty from trade where sec=1 and qty>=400", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[4 0] 400] [[6 0] 600] [[8 0] 800]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, qty from trade where sec=1 and qty>=? and px<? limit 2", []interface{}{100, 17.5})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[2 0] 200] [[4 0] 400]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, qty from trade where sec=1 and qty>=400 limit -1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[8 0] 800]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, qty from trade where sec=1 and time=4 and qty<400", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(ret))
+	ret, err = Execute(db, "test", "select count(*), sum(qty) from trade where sec=2 and px>15", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[2 1600]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select * from trade where qty>100", nil)
+	assert.Equal(t, "Cannot execute this query as it might involve data filtering and thus may have unpredictable performance, restrict the first primary key with '=' or use ALLOW FILTERING", err.Error())
+	_, err = Execute(db, "test", "select * from trade where sec>1 and qty>100", nil)
+	assert.NotEqual(t, nil, err)
+	ret, err = Execute(db, "test", "select sec, qty from trade where qty>500 allow filtering", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 600] [1 800] [2 700] [2 900]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, qty from trade where time>=8 allow filtering", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 800] [2 900]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "delete from trade where sec=1 and qty>100", nil)
+	assert.Equal(t, "Invalid column qty in where clause, only primary key can be used", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_MergeRecords(t *testing.T) {
+	a := []record{{[]byte{1}, [2]tuple.Tuple{{1}, nil}}, {[]byte{3}, [2]tuple.Tuple{{3}, nil}}}
+	b := []record{{[]byte{2}, [2]tuple.Tuple{{2}, nil}}, {[]byte{3}, [2]tuple.Tuple{{3}, nil}}, {[]byte{4}, [2]tuple.Tuple{{4}, nil}}}
+	recs := mergeRecords([][]record{a, b}, 0, false)
+	assert.Equal(t, "[[[1] []] [[2] []] [[3] []] [[4] []]]", fmt.Sprint(recs))
+	recs = mergeRecords([][]record{a, b}, 3, false)
+	assert.Equal(t, "[[[1] []] [[2] []] [[3] []]]", fmt.Sprint(recs))
+	a[0], a[1] = a[1], a[0]
+	b[0], b[2] = b[2], b[0]
+	recs = mergeRecords([][]record{a, b}, 2, true)
+	assert.Equal(t, "[[[4] []] [[3] []]]", fmt.Sprint(recs))
+}
+
+func Test_WhereOr(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for i := 0; i < 12; i++ {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?, ?)", []interface{}{i % 4, i, 10. + float64(i), 100 * i})
+		assert.Equal(t, nil, err)
+	}
+	ret, err := Execute(db, "test", "select sec, qty from trade where sec in (3, 1)", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 100] [1 500] [1 900] [3 300] [3 700] [3 1100]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, qty from trade where sec in (?, ?) and time between ? and ?", []interface{}{1, 2, 2, 6})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 500] [2 200] [2 600]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, qty from trade where sec=0 and time>4 or sec=3 and time<4", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0 800] [3 300]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, qty from trade where (sec=1 or sec=2) and time in (1, 2, 5) limit -2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[2 200] [1 500]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, qty from trade where sec in (1, 2) and qty in (100, 200, 300)", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 100] [2 200]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, qty from trade where sec=1 or sec=1 and time=5", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 100] [1 500] [1 900]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, count(*) from trade where sec in (0, 1, 2) group by sec", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0 3] [1 3] [2 3]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "delete from trade where sec in (0, 1) or sec=2 and time=2", nil)
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select sec, qty from trade where sec>=0", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[2 600] [2 1000] [3 300] [3 700] [3 1100]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select sec, qty from trade where sec=1 or time=1", nil)
+	assert.Equal(t, "Cannot execute this query as it might involve data filtering and thus may have unpredictable performance", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_OrderBy(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for i := 0; i < 12; i++ {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?, ?)", []interface{}{i % 2, i, 10. + float64(i), 100 * i})
+		assert.Equal(t, nil, err)
+	}
+	ret, err := Execute(db, "test", "select qty from trade where sec=1 order by time desc", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1100] [900] [700] [500] [300] [100]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select qty from trade where sec=1 order by time asc limit 2 offset 1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[300] [500]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select qty from trade where sec=0 order by time desc limit 2 offset 4", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[200] [0]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select qty from trade where sec=0 limit 2 offset 10", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, qty from trade where sec in (0, 1) and time>7 order by sec desc limit 3 offset 1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 900] [0 1000] [0 800]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select qty from trade where sec=1 and qty>100 order by time desc limit 2 offset 1 allow filtering", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[900] [700]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, count(*) from trade group by sec order by sec desc limit 1 offset 1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0 6]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select qty from trade order by time", nil)
+	assert.Equal(t, "ORDER BY time requires sec to be restricted by '='", err.Error())
+	_, err = Execute(db, "test", "select qty from trade where sec in (0, 1) order by time desc", nil)
+	assert.Equal(t, "ORDER BY time requires sec to be restricted by one value", err.Error())
+	_, err = Execute(db, "test", "select qty from trade where sec=1 and time<3 or sec=0 and time>9 order by time", nil)
+	assert.Equal(t, "ORDER BY time requires sec to be restricted by one value", err.Error())
+	ret, err = Execute(db, "test", "select qty from trade where sec=1 and time<3 or sec=1 and time>9 order by time desc", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1100] [100]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select qty from trade where sec=1 order by qty", nil)
+	assert.Equal(t, "Invalid column qty in ORDER BY, only primary key can be used", err.Error())
+	_, err = Execute(db, "test", "select qty from trade where sec=1 order by time limit -1", nil)
+	assert.Equal(t, "Negative LIMIT cannot be used with ORDER BY", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_Update(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for i := 0; i < 6; i++ {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?, ?)", []interface{}{i % 2, i, 10. + float64(i), 100 * i})
+		assert.Equal(t, nil, err)
+	}
+	_, err = Execute(db, "test", "update trade set px=?, qty=? where sec=1 and time=?", []interface{}{1.5, 7, 3})
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select time, px, qty from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[1 0] 11 100] [[3 0] 1.5 7] [[5 0] 15 500]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "update trade set qty=0 where sec=0 and time>=?", []interface{}{2})
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select time, px, qty from trade where sec=0", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[0 0] 10 0] [[2 0] 12 0] [[4 0] 14 0]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "update trade set qty=1 where sec=1 and time=4", nil)
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select count(*) from trade", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[6]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "update trade set sec=1 where sec=0", nil)
+	assert.Equal(t, "PRIMARY KEY part sec found in SET part", err.Error())
+	_, err = Execute(db, "test", "update trade set qty=1, qty=2 where sec=0", nil)
+	assert.Equal(t, "Duplicate column name qty", err.Error())
+	_, err = Execute(db, "test", "update trade set qty=1 where sec=0 and px=1", nil)
+	assert.Equal(t, "Invalid column px in where clause, only primary key can be used", err.Error())
+	_, err = Execute(db, "test", "update trade set qty='x' where sec=0", nil)
+	assert.Equal(t, "Invalid string value (x) for \"qty\" of Int", err.Error())
+	_, err = Execute(db, "test", "update trade set qty=? where sec=?", []interface{}{1})
+	assert.Equal(t, "Expected 2 arguments, got 1", err.Error())
+	_, err = Execute(db, "test", "insert into _adj_ values(1, 1, 0.5, 2)", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[{1 0.5 2 2 0.5}]", fmt.Sprint(adjCache.get(db, "test", 1)))
+	_, err = Execute(db, "test", "update _adj_ set px=0.25, vol=4 where sec=1 and time=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[{1 0.25 4 4 0.25}]", fmt.Sprint(adjCache.get(db, "test", 1)))
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_InsertConflict(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "insert into trade values(1, 1, 100)", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(ret))
+	ret, err = Execute(db, "test", "insert into trade values(1, 1, 200) if not exists", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[true]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "insert into trade values(1, 2, 200) if not exists", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[false]]", fmt.Sprint(ret))
+	ast, _ := Parse("insert into trade values(1, ?, ?) if not exists")
+	stmt, err := resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	ret, err = BatchInsert(db, &stmt, [][]interface{}{{3, 300}, {2, 201}, {4, 400}, {1, 101}})
+	assert.Equal(t, "Some rows already exist: 1, 3", err.Error())
+	assert.Equal(t, 0, len(ret))
+	ret, err = Execute(db, "test", "select time, qty from trade where sec=1", nil)
+	assert.Equal(t, "[[[1 0] 100] [[2 0] 200]]", fmt.Sprint(ret))
+	ast, _ = Parse("insert into trade values(1, ?, ?) on conflict do nothing")
+	stmt, err = resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	ret, err = BatchInsert(db, &stmt, [][]interface{}{{3, 300}, {2, 201}, {3, 301}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[false] [true] [true]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, qty from trade where sec=1", nil)
+	assert.Equal(t, "[[[1 0] 100] [[2 0] 200] [[3 0] 300]]", fmt.Sprint(ret))
+	ast, _ = Parse("insert into trade values(1, ?, ?) on conflict do update")
+	stmt, err = resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	ret, err = BatchInsert(db, &stmt, [][]interface{}{{1, 101}, {4, 400}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[true] [false]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, qty from trade where sec=1", nil)
+	assert.Equal(t, "[[[1 0] 101] [[2 0] 200] [[3 0] 300] [[4 0] 400]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 1) if not exists on conflict do nothing", nil)
+	assert.Equal(t, "IF NOT EXISTS cannot be used with ON CONFLICT", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+	// only the given columns are updated
+	_, err = Execute(db, "test", "create table quote(sec int, time timestamp, bid double, ask double, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into quote values(1, 1, 1.5, 1.6)", nil)
+	assert.Equal(t, nil, err)
+	ast, _ = Parse("insert into quote(sec, time, ask) values(1, ?, ?) on conflict do update")
+	stmt, err = resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	ret, err = BatchInsert(db, &stmt, [][]interface{}{{1, 1.7}, {2, 2.6}, {1, 1.8}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[true] [false] [true]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, bid, ask from quote where sec=1", nil)
+	assert.Equal(t, "[[[1 0] 1.5 1.8] [[2 0] <nil> 2.6]]", fmt.Sprint(ret))
+	Execute(db, "", "drop table test.quote", nil)
+}
+
+func Test_BatchInsertChunks(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	n := maxBatchRows
+	maxBatchRows = 2
+	defer func() { maxBatchRows = n }()
+	_, err := Execute(db, "test", "create table trade(sec symbol, time timestamp, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	ast, _ := Parse("insert into trade values(?, ?, ?)")
+	stmt, err := resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	_, err = BatchInsert(db, &stmt, [][]interface{}{{"A", 1, 1}, {"B", 1, 2}, {"A", 2, 3}, {"C", 1, 4}, {"A", 3, 5}})
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select count(*) from trade", nil)
+	assert.Equal(t, "[[5]]", fmt.Sprint(ret))
+	_, err = BatchInsert(db, &stmt, [][]interface{}{{"A", 4, 1}, {"B", 2, 2}, {"A", 5, "x"}})
+	assert.Equal(t, "Row 2: Invalid string value (x) for \"qty\" of Int", err.Error())
+	ret, err = Execute(db, "test", "select count(*) from trade", nil)
+	assert.Equal(t, "[[5]]", fmt.Sprint(ret))
+	ast, _ = Parse("insert into trade values(?, ?, ?) if not exists")
+	stmt, err = resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	// never partially committed
+	ret, err = BatchInsert(db, &stmt, [][]interface{}{{"D", 1, 1}, {"E", 1, 1}, {"D", 2, 1}, {"C", 1, 1}})
+	assert.Equal(t, "Too many rows for IF NOT EXISTS in one transaction, at most 2 rows", err.Error())
+	ret, err = Execute(db, "test", "select count(*) from trade", nil)
+	assert.Equal(t, "[[5]]", fmt.Sprint(ret))
+	ret, err = BatchInsert(db, &stmt, [][]interface{}{{"F", 1, 1}, {"F", 1, 1}})
+	assert.Equal(t, "Some rows already exist: 1", err.Error())
+	ret, err = Execute(db, "test", "select count(*) from trade", nil)
+	assert.Equal(t, "[[5]]", fmt.Sprint(ret))
+	ret, err = BatchInsert(db, &stmt, [][]interface{}{{"F", 1, 1}, {"G", 1, 1}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[false] [false]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select count(*) from trade", nil)
+	assert.Equal(t, "[[7]]", fmt.Sprint(ret))
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_InsertRows(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 100), (1, 2, ?), (?, 3, 300)", []interface{}{200, 2})
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select sec, time, qty from trade", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 [1 0] 100] [1 [2 0] 200] [2 [3 0] 300]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "insert into trade(sec, time, qty) values(1, 2, 0), (1, 4, 400) on conflict do nothing", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[true] [false]]", fmt.Sprint(ret))
+	ast, _ := Parse("insert into trade values(?, 5, ?), (?, 6, ?)")
+	stmt, err := resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	_, err = BatchInsert(db, &stmt, [][]interface{}{{3, 500, 3, 600}, {4, 500, 4, 600}})
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select sec, time, qty from trade where sec>=3", nil)
+	assert.Equal(t, "[[3 [5 0] 500] [3 [6 0] 600] [4 [5 0] 500] [4 [6 0] 600]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "insert into trade values(1, 7, 700), (1, 8)", nil)
+	assert.Equal(t, "Unmatched column names/values", err.Error())
+	_, err = Execute(db, "test", "insert into trade values(1, 7, 700), (1, 8, 'x')", nil)
+	assert.Equal(t, "Invalid string value (x) for \"qty\" of Int", err.Error())
+	ret, err = Execute(db, "test", "select count(*) from trade where sec=1", nil)
+	assert.Equal(t, "[[3]]", fmt.Sprint(ret))
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_IntRange(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, a tinyint, b smallint, c int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 128, 0, 0)", nil)
+	assert.Equal(t, "Value 128 out of range for \"a\" of TinyInt", err.Error())
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 0, -32769, 0)", nil)
+	assert.Equal(t, "Value -32769 out of range for \"b\" of SmallInt", err.Error())
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 0, 0, 0), (1, 2, 0, 0, 2147483648)", nil)
+	assert.Equal(t, "Row 1: Value 2147483648 out of range for \"c\" of Int", err.Error())
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 127, -32768, ?)", []interface{}{2147483648})
+	assert.Equal(t, "Value 2147483648 out of range for \"c\" of Int", err.Error())
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 128, -32769, ?) saturate", []interface{}{2147483648})
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select a, b, c from trade where sec=1", nil)
+	assert.Equal(t, "[[127 -32768 2147483647]]", fmt.Sprint(ret))
+	ast, _ := Parse("insert into trade values(1, ?, ?, 0, 0)")
+	stmt, err := resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	_, err = BatchInsert(db, &stmt, [][]interface{}{{2, 1}, {3, 1000}, {4, 1}})
+	assert.Equal(t, "Row 1: Value 1000 out of range for \"a\" of TinyInt", err.Error())
+	_, err = Execute(db, "test", "update trade set a=? where sec=1", []interface{}{-129})
+	assert.Equal(t, "Value -129 out of range for \"a\" of TinyInt", err.Error())
+	_, err = Execute(db, "test", "update trade set a=? where sec=1 saturate", []interface{}{-129})
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select a from trade where sec=1 and c>3000000000", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select a from trade where sec=1 and c<=3000000000", nil)
+	assert.Equal(t, "[[-128]]", fmt.Sprint(ret))
+	// out of range operands are not clamped
+	for _, sql := range []string{"c>=3000000000", "c=3000000000", "c in (3000000000, 3000000001)", "c>=?", "c=?"} {
+		var args []interface{}
+		if strings.Contains(sql, "?") {
+			args = []interface{}{3000000000}
+		}
+		ret, err = Execute(db, "test", "select a from trade where sec=1 and "+sql, args)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "[]", fmt.Sprint(ret))
+	}
+	ret, err = Execute(db, "test", "select a from trade where sec=? and c<3000000000", []interface{}{4294967297})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[]", fmt.Sprint(ret))
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_Null(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double not null, qty int default 100, venue text, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	tbl, _ := GetTableSchema(db, "test", "trade")
+	assert.Equal(t, true, tbl.NameMap["px"].NotNull)
+	assert.Equal(t, int64(100), tbl.NameMap["qty"].Default)
+	_, err = Execute(db, "test", "insert into trade(sec, time, px) values(1, 1, 1.5)", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, 2, 2.5, null, 'X')", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, 3, 3.5, ?, ?)", []interface{}{300, nil})
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade(sec, time, qty) values(1, 4, 1)", nil)
+	assert.Equal(t, "Column px cannot be null", err.Error())
+	_, err = Execute(db, "test", "insert into trade values(1, 4, null, 1, 'X')", nil)
+	assert.Equal(t, "Column px cannot be null", err.Error())
+	_, err = Execute(db, "test", "insert into trade values(1, 4, ?, 1, 'X')", []interface{}{nil})
+	assert.Equal(t, "Column px cannot be null", err.Error())
+	_, err = Execute(db, "test", "insert into trade values(?, 4, 1, 1, 'X')", []interface{}{nil})
+	assert.Equal(t, "Column sec cannot be null", err.Error())
+	ret, err := Execute(db, "test", "select time, qty, venue from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[1 0] 100 <nil>] [[2 0] <nil> X] [[3 0] 300 <nil>]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time from trade where sec=1 and qty is null", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[2 0]]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time from trade where sec=1 and venue is not null or sec=1 and qty=300", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[2 0]] [[3 0]]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time from trade where sec=1 and qty=null", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "update trade set venue=null, qty=? where sec=1 and time=2", []interface{}{nil})
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select time from trade where sec=1 and venue is null and qty is null", nil)
+	assert.Equal(t, "[[[2 0]]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "update trade set px=null where sec=1", nil)
+	assert.Equal(t, "Column px cannot be null", err.Error())
+	_, err = Execute(db, "test", "select time from trade where sec is null", nil)
+	assert.Equal(t, "Invalid IS NULL on primary key sec", err.Error())
+	_, err = Execute(db, "test", "alter table trade add column x int not null", nil)
+	assert.Equal(t, "NOT NULL column x requires a DEFAULT", err.Error())
+	_, err = Execute(db, "test", "create table t2(a int default 1, b int, primary key(a))", nil)
+	assert.Equal(t, "DEFAULT not allowed on PRIMARY KEY column a", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_NewTypes(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec symbol, time timestamp, px decimal(10, 4), raw blob, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values('AAPL', 1, '1.23456', ?), ('MSFT', 1, 2, 'x'), (?, 2, ?, null)", []interface{}{[]byte{0, 1}, "AAPL", 1.5})
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select sec, time, px, raw from trade where sec='AAPL'", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[AAPL [1 0] 1.2346 [0 1]] [AAPL [2 0] 1.5000 <nil>]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sec, px from trade where sec in ('MSFT', 'IBM') and px >= 2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[MSFT 2.0000]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sum(px), avg(px), max(px), last(sec) from trade where sec=? group by sec", []interface{}{"AAPL"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[2.7346 1.3673 1.5000 AAPL]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "update trade set px=? where sec='MSFT' and time=1", []interface{}{"3.1"})
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select px from trade where sec='MSFT'", nil)
+	assert.Equal(t, "[[3.1000]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "insert into trade values('IBM', 1, 1234567, null)", nil)
+	assert.Equal(t, "Invalid value (1234567) for \"px\" of Decimal(10,4)", err.Error())
+	_, err = Execute(db, "test", "select * from trade where sec>'A'", nil)
+	assert.Equal(t, "Invalid operator (>) for \"sec\" of type Symbol", err.Error())
+	_, err = Execute(db, "test", "select max(sec) from trade where sec='A' group by sec", nil)
+	assert.Equal(t, "Invalid aggregate max on \"sec\" of type Symbol", err.Error())
+	_, err = Execute(db, "test", "select adj(px) from trade where sec='A'", nil)
+	assert.Equal(t, "adj not supported on column px of Decimal", err.Error())
+	_, err = Execute(db, "test", "create table t2(a int, b symbol default 'X', primary key(a))", nil)
+	assert.Equal(t, "DEFAULT not allowed on column b of type Symbol", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_Now(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, now() - interval '1 hour', 1), (1, now() - interval '10 minutes', 2), (1, timestamp '2026-01-02 09:30:00' at time zone 'America/New_York', 3)", nil)
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select px from trade where sec=1 and time > now() - interval '15 minutes' and time <= now()", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[2]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, to_timezone(time, 'Asia/Tokyo') from trade where sec=1 and time=?", []interface{}{"2026-01-02T14:30:00Z"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[1767364200 0] 2026-01-02T23:30:00+09:00]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select to_timezone(px, 'UTC') from trade where sec=1", nil)
+	assert.Equal(t, "to_timezone not supported on column px of Double", err.Error())
+	_, err = Execute(db, "test", "alter table trade add column tm2 timestamp default now()", nil)
+	assert.Equal(t, "NOW() not allowed in DEFAULT", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_QuerySelectExpr(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 1.5, 100), (1, 2, 2.5, 200), (1, 3, 2, null)", nil)
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select time, px * qty as notional, case when px > 2 then 'up' else 'down' end from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[1 0] 150 down] [[2 0] 500 up] [[3 0] <nil> down]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select max(px) - min(px), count(*) from trade where sec=1 group by sec", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 3]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select px, round(px / 3, 2) from trade where sec=1 limit -1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[2 0.67]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select px + vol from trade where sec=1", nil)
+	assert.Equal(t, "Undefined column name vol", err.Error())
+	_, err = Execute(db, "test", "select time, px * 2 from trade where sec=1 group by sec", nil)
+	assert.Equal(t, "Column time must appear in the GROUP BY clause or be used in an aggregate function", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_AsofJoin(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "create table quote(sec int, time timestamp, bid double, ask double, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "create table bar(sec int, interval int, time timestamp, px double, primary key(sec, interval, time))", nil)
+	assert.Equal(t, nil, err)
+	for _, args := range [][]interface{}{{1, 5, 10.1, 100}, {1, 10, 10.2, 200}, {1, 20, 10.3, 300}, {2, 1, 20.1, 10}, {2, 15, 20.2, 20}} {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?, ?)", args)
+		assert.Equal(t, nil, err)
+	}
+	for _, args := range [][]interface{}{{1, 1, 10, 10.5}, {1, 10, 10.1, 10.4}, {1, 15, 10.2, 10.3}, {2, 5, 20, 20.5}} {
+		_, err = Execute(db, "test", "insert into quote values(?, ?, ?, ?)", args)
+		assert.Equal(t, nil, err)
+	}
+	ret, err := Execute(db, "test", "select sec, time, px, bid, ask, quote.time from trade asof join quote on sec", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 [5 0] 10.1 10 10.5 [1 0]] [1 [10 0] 10.2 10.1 10.4 [10 0]] [1 [20 0] 10.3 10.2 10.3 [15 0]] [2 [1 0] 20.1 <nil> <nil> <nil>] [2 [15 0] 20.2 20 20.5 [5 0]]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, bid from trade asof join quote on sec where sec=1 and time>=10", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[10 0] 10.1] [[20 0] 10.2]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select time, bid from trade asof join quote on sec where sec=1 limit -2", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[20 0] 10.2] [[10 0] 10.1]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select * from trade asof join quote on sec where sec=1 and time=20", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 [20 0] 10.3 300 10.2 10.3]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "select time, bid from trade asof join bar on sec", nil)
+	assert.Equal(t, "ASOF JOIN must be ON all primary keys but the last one of both tables", err.Error())
+	_, err = Execute(db, "test", "select time, bid from trade asof join quote on time", nil)
+	assert.Equal(t, "ON column time must be primary key #1 of the same type in both tables", err.Error())
+	_, err = Execute(db, "test", "select time, max(bid) from trade asof join quote on sec", nil)
+	assert.Equal(t, "Aggregate not supported with ASOF JOIN", err.Error())
+	_, err = Execute(db, "test", "select time, x.bid from trade asof join quote on sec", nil)
+	assert.Equal(t, "Unknown table x", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+	Execute(db, "", "drop table test.quote", nil)
+	Execute(db, "", "drop table test.bar", nil)
+}
+
 func Benchmark_resolveDelete(b *testing.B) {
 	fdb.MustAPIVersion(FdbVersion)
 	var db = fdb.MustOpenDefault()
@@ -0,0 +1,115 @@
+package opentick
+
+import (
+	"bytes"
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"sort"
+)
+
+// key-values read in one transaction of a paged scan, to stay far below the 5 seconds limit
+var scanPageSize = 10000
+
+// ranges must be disjoint, in key order or in reverse order if reverse
+func sortRanges(ranges []whereRange, reverse bool) {
+	sort.SliceStable(ranges, func(i, j int) bool {
+		a, _ := rangeKeys(&ranges[i])
+		b, _ := rangeKeys(&ranges[j])
+		if reverse {
+			return bytes.Compare(a, b) > 0
+		}
+		return bytes.Compare(a, b) < 0
+	})
+}
+
+// read ranges page by page, every page in its own transaction resuming after the last key read,
+// fn is called with records of every non-empty page until limit records passed if limit > 0
+func scanRanges(db fdb.Transactor, schema *TableSchema, ranges []whereRange, limit int, reverse bool, fn func([][2]tuple.Tuple) error) (err error) {
+	return scanRecords(db, schema, ranges, limit, reverse, func(page []record) error {
+		recs := make([][2]tuple.Tuple, len(page))
+		for i := range page {
+			recs[i] = page[i].rec
+		}
+		return fn(recs)
+	})
+}
+
+// scanRanges with keys of records
+func scanRecords(db fdb.Transactor, schema *TableSchema, ranges []whereRange, limit int, reverse bool, fn func([]record) error) (err error) {
+	n := 0
+	for i := range ranges {
+		r := ranges[i]
+		for limit <= 0 || n < limit {
+			pageLimit := scanPageSize
+			if limit > 0 && limit-n < pageLimit {
+				pageLimit = limit - n
+			}
+			var last fdb.Key
+			tmp, err1 := db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
+				ret, last, err = readPage(tr, schema, &r, pageLimit, reverse)
+				return
+			})
+			if err1 != nil {
+				return err1
+			}
+			recs := tmp.([]record)
+			n += len(recs)
+			if len(recs) > 0 {
+				if err = fn(recs); err != nil {
+					return
+				}
+			}
+			if last == nil {
+				break
+			}
+			if reverse {
+				r.Range.End = last
+			} else {
+				r.Range.Begin = append(last[:len(last):len(last)], 0x00)
+			}
+		}
+	}
+	return
+}
+
+// at most limit records, last is the last key read if the range is not exhausted
+func readPage(tr fdb.Transaction, schema *TableSchema, r *whereRange, limit int, reverse bool) (recs []record, last fdb.Key, err error) {
+	if r.Key != nil {
+		recs, err = readRange(tr, schema, r, 0, reverse)
+		return
+	}
+	if limit <= 0 || limit > scanPageSize {
+		err = errors.New("Internal errror: invalid page limit")
+		return
+	}
+	opts := fdb.RangeOptions{Limit: scanPageSize, Reverse: reverse}
+	if r.Filters == nil {
+		opts.Limit = limit
+	}
+	kvs, err := getRange(tr, schema, r.Range, opts)
+	if err != nil {
+		return
+	}
+	for i, kv := range kvs {
+		rec, err1 := unpackRecord(schema, kv)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		if !matchFilters(r.Filters, rec) {
+			continue
+		}
+		recs = append(recs, record{kv.Key, rec})
+		if len(recs) >= limit {
+			if i < len(kvs)-1 || len(kvs) == opts.Limit {
+				last = kv.Key
+			}
+			return
+		}
+	}
+	if len(kvs) == opts.Limit {
+		last = kvs[len(kvs)-1].Key
+	}
+	return
+}
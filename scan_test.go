@@ -0,0 +1,77 @@
+package opentick
+
+import (
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_SortRanges(t *testing.T) {
+	r := func(a string, b string) whereRange {
+		return whereRange{Range: fdb.KeyRange{Begin: fdb.Key(a), End: fdb.Key(b)}}
+	}
+	ranges := []whereRange{r("c", "d"), {Key: []byte("b")}, r("a", "b")}
+	sortRanges(ranges, false)
+	assert.Equal(t, []whereRange{r("a", "b"), {Key: []byte("b")}, r("c", "d")}, ranges)
+	sortRanges(ranges, true)
+	assert.Equal(t, []whereRange{r("c", "d"), {Key: []byte("b")}, r("a", "b")}, ranges)
+}
+
+func Test_ScanPages(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	n := scanPageSize
+	scanPageSize = 2
+	defer func() { scanPageSize = n }()
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	for i := 0; i < 7; i++ {
+		_, err = Execute(db, "test", "insert into trade values(?, ?, ?)", []interface{}{i % 2, i, i})
+		assert.Equal(t, nil, err)
+	}
+	ret, err := Execute(db, "test", "select qty from trade", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0] [2] [4] [6] [1] [3] [5]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select qty from trade where sec in (1, 0) limit -4 offset 1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[3] [1] [6] [4]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select qty from trade where qty > 1 limit 3 allow filtering", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[2] [4] [6]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select sum(qty) from trade", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[21]]", fmt.Sprint(ret))
+	// overlapped branches, read by fewer workers than branches
+	workers := maxReadWorkers
+	maxReadWorkers = 2
+	ret, err = Execute(db, "test", "select qty from trade where sec=0 or sec=0 and time>2 or sec=1 and time<4 or sec=1 and time>4", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0] [2] [4] [6] [1] [3] [5]]", fmt.Sprint(ret))
+	ret, err = Execute(db, "test", "select qty from trade where sec=0 or sec=0 and time>2 limit 3", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0] [2] [4]]", fmt.Sprint(ret))
+	maxReadWorkers = workers
+	var pages []int
+	err = ExecuteStream(db, "test", "select qty from trade where sec=0", nil, func(rows [][]interface{}) error {
+		pages = append(pages, len(rows))
+		return nil
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{2, 2}, pages)
+	// aggregated page by page, passed at once
+	var rows [][]interface{}
+	err = ExecuteStream(db, "test", "select sec, sum(qty), count(*) from trade group by sec", nil, func(res [][]interface{}) error {
+		rows = append(rows, res...)
+		return nil
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[0 12 4] [1 9 3]]", fmt.Sprint(rows))
+	err = ExecuteStream(db, "test", "select qty from trade where sec=0 or sec=0 and time>2", nil, func(res [][]interface{}) error {
+		return nil
+	})
+	assert.Equal(t, "Select with ASOF JOIN or overlapped OR branches cannot be streamed", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
@@ -1,12 +1,18 @@
 package opentick
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type DataType uint32
@@ -24,9 +30,28 @@ const (
 	Timestamp
 	Boolean
 	Text
+	Decimal // scaled int64
+	Blob
+	Symbol // int64 id in dictionary of database
 )
 
-var typeNames = []string{"TinyInt", "SmallInt", "Int", "BigInt", "Double", "Float", "Timestamp", "Boolean", "Text"}
+var typeNames = []string{"TinyInt", "SmallInt", "Int", "BigInt", "Double", "Float", "Timestamp", "Boolean", "Text", "Decimal", "Blob", "Symbol"}
+
+var dataTypes = map[string]DataType{
+	"TINYINT":   TinyInt,
+	"SMALLINT":  SmallInt,
+	"INT":       Int,
+	"BIGINT":    BigInt,
+	"DOUBLE":    Double,
+	"FLOAT":     Float,
+	"TIMESTAMP": Timestamp,
+	"BOOLEAN":   Boolean,
+	"TEXT":      Text,
+	"DECIMAL":   Decimal,
+	"BLOB":      Blob,
+	"BYTES":     Blob,
+	"SYMBOL":    Symbol,
+}
 
 func (self *DataType) Name() string {
 	i := int(*self)
@@ -119,7 +144,10 @@ func DropDatabase(db fdb.Transactor, dbName string) (err error) {
 		}
 	}
 	_, err = directory.Root().Remove(db, path)
-	return
+	if err != nil {
+		return
+	}
+	return dropSymbolDict(db, dbName)
 }
 
 type typeTuple struct {
@@ -128,11 +156,15 @@ type typeTuple struct {
 }
 
 type TableColDef struct {
-	Name   string
-	Type   DataType
-	IsKey  bool
-	PosCol uint32
-	Pos    uint32 // position in Key or Values
+	Name      string
+	Type      DataType
+	IsKey     bool
+	PosCol    uint32
+	Pos       uint32      // position in Key or Values
+	Default   interface{} // also used for rows written before the column was added
+	NotNull   bool
+	Precision uint32 // of decimal
+	Scale     uint32 // of decimal
 }
 
 func NewTableColDef(name string, t DataType) (tbl *TableColDef) {
@@ -142,15 +174,38 @@ func NewTableColDef(name string, t DataType) (tbl *TableColDef) {
 	return
 }
 
-const schemaVersion uint32 = 1
+const schemaVersion uint32 = 5
+
+// version 1 wrote number of columns in place of version, so a flag is set to tell them apart
+const schemaVersionFlag uint32 = 1 << 31
 
 func (self *TableColDef) encode() []byte {
 	var out []byte
 	var tmp [4]byte
 	bn := tmp[:]
 	binary.BigEndian.PutUint32(bn, uint32(len(self.Name)))
-	out = append(bn, []byte(self.Name)...)
+	out = append(out, bn...)
+	out = append(out, []byte(self.Name)...)
 	binary.BigEndian.PutUint32(bn, uint32(self.Type))
+	out = append(out, bn...)
+	binary.BigEndian.PutUint32(bn, self.Pos)
+	out = append(out, bn...)
+	var def []byte
+	if self.Default != nil {
+		def = tuple.Tuple{self.Default}.Pack()
+	}
+	binary.BigEndian.PutUint32(bn, uint32(len(def)))
+	out = append(out, bn...)
+	out = append(out, def...)
+	var flags uint32
+	if self.NotNull {
+		flags |= 1
+	}
+	binary.BigEndian.PutUint32(bn, flags)
+	out = append(out, bn...)
+	binary.BigEndian.PutUint32(bn, self.Precision)
+	out = append(out, bn...)
+	binary.BigEndian.PutUint32(bn, self.Scale)
 	return append(out, bn...)
 }
 
@@ -160,17 +215,46 @@ func decodeTableColDef(bytes []byte, out *TableColDef, version uint32) []byte {
 	out.Name = string(bytes[:n])
 	bytes = bytes[n:]
 	out.Type = DataType(binary.BigEndian.Uint32(bytes))
-	return bytes[4:]
+	bytes = bytes[4:]
+	if version < 2 {
+		return bytes
+	}
+	out.Pos = binary.BigEndian.Uint32(bytes)
+	bytes = bytes[4:]
+	n = binary.BigEndian.Uint32(bytes)
+	bytes = bytes[4:]
+	if n > 0 {
+		def, _ := tuple.Unpack(bytes[:n])
+		out.Default = def[0]
+	}
+	bytes = bytes[n:]
+	if version < 3 {
+		return bytes
+	}
+	flags := binary.BigEndian.Uint32(bytes)
+	out.NotNull = flags&1 != 0
+	bytes = bytes[4:]
+	if version < 4 {
+		return bytes
+	}
+	out.Precision = binary.BigEndian.Uint32(bytes)
+	out.Scale = binary.BigEndian.Uint32(bytes[4:])
+	return bytes[8:]
 }
 
 type TableSchema struct {
-	DbName  string
-	TblName string
-	Cols    []*TableColDef
-	Keys    []*TableColDef
-	Values  []*TableColDef
-	NameMap map[string]*TableColDef
-	Dir     directory.DirectorySubspace
+	DbName   string
+	TblName  string
+	Cols     []*TableColDef
+	Keys     []*TableColDef
+	Values   []*TableColDef
+	ValueLen int // length of value tuple, including positions of dropped columns
+	NameMap  map[string]*TableColDef
+	Options  map[string]string // of WITH clause
+	Dir      directory.DirectorySubspace
+	key      fdb.Key // of the stored schema
+	stored   []byte  // encoded schema when loaded, to detect alters by other servers
+	checked  int64   // unix nanoseconds of the last checkSchema by reads
 }
 
 func NewTableSchema(cols []*TableColDef, keys []int) (tbl TableSchema) {
@@ -184,6 +268,8 @@ func NewTableSchema(cols []*TableColDef, keys []int) (tbl TableSchema) {
 }
 
 func (self *TableSchema) fill() {
+	// value columns keep their positions once assigned, they can not move after columns added or dropped
+	keepPos := self.ValueLen > 0
 	self.Values = make([]*TableColDef, len(self.Cols)-len(self.Keys))
 	for i, col := range self.Keys {
 		col.IsKey = true
@@ -196,18 +282,42 @@ func (self *TableSchema) fill() {
 		self.NameMap[col.Name] = col
 		if !col.IsKey {
 			self.Values[n] = col
-			col.Pos = uint32(n)
+			if !keepPos {
+				col.Pos = uint32(n)
+			}
 			n++
 		}
 	}
+	if !keepPos {
+		self.ValueLen = n
+	}
+}
+
+// pad value tuple written before columns added with defaults,
+// and convert float written before the column widened to double
+func (self *TableSchema) decodeValue(value tuple.Tuple) tuple.Tuple {
+	n := len(value)
+	for len(value) < self.ValueLen {
+		value = append(value, nil)
+	}
+	for _, col := range self.Values {
+		if int(col.Pos) >= n {
+			value[col.Pos] = col.Default
+		} else if col.Type == Double {
+			if v, ok := value[col.Pos].(float32); ok {
+				value[col.Pos] = float64(v)
+			}
+		}
+	}
+	return value
 }
 
 func (self *TableSchema) encode() []byte {
 	var out []byte
 	var tmp [4]byte
 	bn := tmp[:]
-	binary.BigEndian.PutUint32(bn, schemaVersion)
-	out = bn
+	binary.BigEndian.PutUint32(bn, schemaVersionFlag|schemaVersion)
+	out = append(out, bn...)
 	binary.BigEndian.PutUint32(bn, uint32(len(self.Cols)))
 	out = append(out, bn...)
 	for _, col := range self.Cols {
@@ -219,11 +329,30 @@ func (self *TableSchema) encode() []byte {
 		binary.BigEndian.PutUint32(bn, uint32(k.PosCol))
 		out = append(out, bn...)
 	}
-	return out
+	binary.BigEndian.PutUint32(bn, uint32(self.ValueLen))
+	out = append(out, bn...)
+	var names []string
+	for name := range self.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var opts tuple.Tuple
+	for _, name := range names {
+		opts = append(opts, name, self.Options[name])
+	}
+	packed := opts.Pack()
+	binary.BigEndian.PutUint32(bn, uint32(len(packed)))
+	out = append(out, bn...)
+	return append(out, packed...)
 }
 
 func decodeTableSchema(bytes []byte) *TableSchema {
 	v := binary.BigEndian.Uint32(bytes)
+	if v&schemaVersionFlag == 0 {
+		v = 1
+	} else {
+		v &^= schemaVersionFlag
+	}
 	bytes = bytes[4:]
 	n := binary.BigEndian.Uint32(bytes)
 	bytes = bytes[4:]
@@ -240,10 +369,59 @@ func decodeTableSchema(bytes []byte) *TableSchema {
 		bytes = bytes[4:]
 	}
 	tbl := TableSchema{Cols: cols, Keys: keys}
+	if v >= 2 {
+		tbl.ValueLen = int(binary.BigEndian.Uint32(bytes))
+		bytes = bytes[4:]
+	}
+	if v >= 5 {
+		n = binary.BigEndian.Uint32(bytes)
+		opts, _ := tuple.Unpack(bytes[4 : 4+n])
+		for i := 0; i+1 < len(opts); i += 2 {
+			if tbl.Options == nil {
+				tbl.Options = make(map[string]string)
+			}
+			tbl.Options[opts[i].(string)] = opts[i+1].(string)
+		}
+	}
 	tbl.fill()
 	return &tbl
 }
 
+func resolveTableOptions(tbl *TableSchema, opts []AstOption) (err error) {
+	for _, opt := range opts {
+		name := strings.ToLower(*opt.Name)
+		value := strings.ToLower(*opt.Value)
+		if _, ok := tbl.Options[name]; ok {
+			return errors.New("Duplicate table option " + name)
+		}
+		switch name {
+		case "storage":
+			if value != "row" && value != "block" {
+				return errors.New("Invalid storage '" + *opt.Value + "', row or block expected")
+			}
+			if value == "block" && tbl.Keys[len(tbl.Keys)-1].Type != Timestamp {
+				return errors.New("Block storage requires the last primary key to be timestamp")
+			}
+		case "compression":
+			if _, ok := compressors[value]; !ok && value != "none" {
+				return errors.New("Invalid compression '" + *opt.Value + "', zstd, lz4 or none expected")
+			}
+		default:
+			return errors.New("Unknown table option " + *opt.Name)
+		}
+		if tbl.Options == nil {
+			tbl.Options = make(map[string]string)
+		}
+		tbl.Options[name] = value
+	}
+	return
+}
+
+// rows of a key prefix are packed into columnar blocks
+func (self *TableSchema) blocks() bool {
+	return self.Options["storage"] == "block"
+}
+
 func CreateAdj(db fdb.Transactor, dbName string) (err error) {
 	stmt, err1 := Parse(`
 	create table _adj_(
@@ -306,9 +484,17 @@ func CreateTable(db fdb.Transactor, dbName string, ast *AstCreateTable) (err err
 			return
 		}
 		i := len(m)
-		t := parseDataType(*f.Type)
-		m[*f.Name] = typeTuple{uint32(i), t}
-		tbl.Cols = append(tbl.Cols, NewTableColDef(*f.Name, t))
+		col, err1 := newTableColDef(*f.Name, string(*f.Type), f.Params)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		m[*f.Name] = typeTuple{uint32(i), col.Type}
+		err = resolveColConstraints(col, f.Constraints)
+		if err != nil {
+			return
+		}
+		tbl.Cols = append(tbl.Cols, col)
 	}
 	has := map[string]bool{}
 	for _, k := range keyStrs {
@@ -321,12 +507,21 @@ func CreateTable(db fdb.Transactor, dbName string, ast *AstCreateTable) (err err
 			return
 		}
 		has[k] = true
-		tbl.Keys = append(tbl.Keys, tbl.Cols[m[k].i])
+		col := tbl.Cols[m[k].i]
+		if col.Default != nil {
+			err = errors.New("DEFAULT not allowed on PRIMARY KEY column " + k)
+			return
+		}
+		tbl.Keys = append(tbl.Keys, col)
 	}
 	if len(tbl.Keys) == 0 {
 		err = errors.New("PRIMARY KEY not declared")
 		return
 	}
+	err = resolveTableOptions(&tbl, ast.Options)
+	if err != nil {
+		return
+	}
 	_, err = db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
 		dirTable, err2 := directory.Create(tr, pathTable, nil)
 		if err2 != nil {
@@ -397,46 +592,200 @@ func RenameTable(db fdb.Transactor, tbl *TableSchema, colOldNewName []string, ne
 	// rename col name below
 	from := colOldNewName[0]
 	to := colOldNewName[1]
-	_, dirSchema, err1 := openTable(db, tbl.DbName, tbl.TblName)
-	if err1 != nil {
-		return err1
-	}
-	tbl = decodeTableSchema(tbl.encode()) //  modify copied to avoid thread issue
-	col, ok := tbl.NameMap[from]
-	if !ok {
-		return errors.New("Column " + from + " does not exist")
-	}
-	if _, ok := tbl.NameMap[to]; ok {
-		return errors.New("Column " + to + " already exists")
+	return alterSchema(db, tbl, func(tbl *TableSchema) error {
+		col, ok := tbl.NameMap[from]
+		if !ok {
+			return errors.New("Column " + from + " does not exist")
+		}
+		if _, ok := tbl.NameMap[to]; ok {
+			return errors.New("Column " + to + " already exists")
+		}
+		col.Name = to
+		tbl.fill()
+		return nil
+	})
+}
+
+// modify the stored schema in one transaction, so that concurrent alters do not lose updates,
+// writes with the schema cached before fail in checkSchema, unless only columns renamed
+func alterSchema(db fdb.Transactor, tbl *TableSchema, fn func(tbl *TableSchema) error) (err error) {
+	_, dirSchema, err := openTable(db, tbl.DbName, tbl.TblName)
+	if err != nil {
+		return
 	}
-	col.Name = to
 	_, err = db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
+		stored, err := tr.Get(dirSchema).Get()
+		if err != nil {
+			return
+		}
+		tbl := decodeTableSchema(stored)
+		if err = fn(tbl); err != nil {
+			return
+		}
 		tr.Set(dirSchema, tbl.encode())
 		return
 	})
+	TableSchemaMap.Delete(tbl.DbName + "." + tbl.TblName)
+	// reads of statements resolved before check again
+	atomic.StoreInt64(&tbl.checked, 0)
+	return
+}
+
+// the statement must be resolved again with the new schema, nothing has been written
+type schemaAlteredError struct {
+	table string
+}
+
+func (self schemaAlteredError) Error() string {
+	return "Table " + self.table + " has been altered, please retry"
+}
+
+func isSchemaAltered(err error) bool {
+	_, ok := err.(schemaAlteredError)
+	return ok
+}
+
+// fails if the table was altered since its schema was cached, also by other servers
+func checkSchema(tr fdb.ReadTransaction, tbl *TableSchema) (err error) {
+	if tbl.key == nil {
+		return
+	}
+	stored, err := tr.Get(tbl.key).Get()
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(stored, tbl.stored) {
+		TableSchemaMap.Delete(tbl.DbName + "." + tbl.TblName)
+		// statements resolved before a rename still encode the same
+		if stored == nil || decodeTableSchema(stored).layout() != tbl.layout() {
+			err = schemaAlteredError{tbl.DbName + "." + tbl.TblName}
+		}
+	}
 	return
 }
 
+// encoded schema without column names
+func (self *TableSchema) layout() string {
+	tbl := *self
+	tbl.Cols = make([]*TableColDef, len(self.Cols))
+	for i, col := range self.Cols {
+		col2 := *col
+		col2.Name = ""
+		tbl.Cols[i] = &col2
+	}
+	return string(tbl.encode())
+}
+
+// reads check the schema at most once per this interval, so that alters by other servers are seen
+var schemaCheckInterval = time.Second
+
+func checkSchemaForRead(db fdb.Transactor, tbl *TableSchema) (err error) {
+	now := time.Now().UnixNano()
+	if tbl.key == nil || now-atomic.LoadInt64(&tbl.checked) < int64(schemaCheckInterval) {
+		return
+	}
+	_, err = db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+		return nil, checkSchema(tr, tbl)
+	})
+	if err == nil {
+		atomic.StoreInt64(&tbl.checked, now)
+	}
+	return
+}
+
+func AddColumn(db fdb.Transactor, tbl *TableSchema, col *TableColDef) (err error) {
+	return alterSchema(db, tbl, func(tbl *TableSchema) error {
+		if _, ok := tbl.NameMap[col.Name]; ok {
+			return errors.New("Column " + col.Name + " already exists")
+		}
+		col.Pos = uint32(tbl.ValueLen)
+		tbl.ValueLen++
+		tbl.Cols = append(tbl.Cols, col)
+		tbl.fill()
+		return nil
+	})
+}
+
+// the dropped column's data is left in place and ignored on read
+func DropColumn(db fdb.Transactor, tbl *TableSchema, name string) (err error) {
+	return alterSchema(db, tbl, func(tbl *TableSchema) error {
+		col, ok := tbl.NameMap[name]
+		if !ok {
+			return errors.New("Column " + name + " does not exist")
+		}
+		if col.IsKey {
+			return errors.New("Cannot drop PRIMARY KEY column " + name)
+		}
+		cols := make([]*TableColDef, 0, len(tbl.Cols)-1)
+		for _, col2 := range tbl.Cols {
+			if col2 != col {
+				cols = append(cols, col2)
+			}
+		}
+		tbl.Cols = cols
+		tbl.fill()
+		return nil
+	})
+}
+
+// only widening allowed, stored values are converted on read
+func AlterColumnType(db fdb.Transactor, tbl *TableSchema, name string, t DataType) (err error) {
+	return alterSchema(db, tbl, func(tbl *TableSchema) error {
+		col, ok := tbl.NameMap[name]
+		if !ok {
+			return errors.New("Column " + name + " does not exist")
+		}
+		if col.Type == t {
+			return nil
+		}
+		widening := false
+		switch col.Type {
+		case TinyInt, SmallInt, Int:
+			widening = t > col.Type && t <= BigInt
+		case Float:
+			// float and double keys are encoded differently
+			widening = t == Double && !col.IsKey
+		}
+		if !widening {
+			return errors.New("Cannot change type of column " + name + " from " + col.Type.Name() + " to " + t.Name())
+		}
+		col.Type = t
+		if v, ok := col.Default.(float32); ok {
+			col.Default = float64(v)
+		}
+		return nil
+	})
+}
+
 func parseDataType(typeStr string) (d DataType) {
-	switch strings.ToUpper(typeStr) {
-	case "TINYINT":
-		return TinyInt
-	case "SMALLINT":
-		return SmallInt
-	case "INT":
-		return Int
-	case "BIGINT":
-		return BigInt
-	case "DOUBLE":
-		return Double
-	case "FLOAT":
-		return Float
-	case "TIMESTAMP":
-		return Timestamp
-	case "BOOLEAN":
-		return Boolean
-	case "TEXT":
-		return Text
+	return dataTypes[strings.ToUpper(typeStr)]
+}
+
+func newTableColDef(name string, typeStr string, params []int64) (col *TableColDef, err error) {
+	col = NewTableColDef(name, parseDataType(typeStr))
+	if col.Type != Decimal {
+		if params != nil {
+			err = errors.New("Type " + col.Type.Name() + " does not accept parameters")
+		}
+		return
+	}
+	col.Precision = maxDecimalPrecision
+	if len(params) > 0 {
+		col.Precision = uint32(params[0])
+		if params[0] < 1 || params[0] > maxDecimalPrecision {
+			err = errors.New("DECIMAL precision must be between 1 and " + strconv.Itoa(maxDecimalPrecision))
+			return
+		}
+	}
+	if len(params) > 1 {
+		col.Scale = uint32(params[1])
+		if params[1] < 0 || params[1] > params[0] {
+			err = errors.New("DECIMAL scale must be between 0 and precision")
+			return
+		}
+	}
+	if len(params) > 2 {
+		err = errors.New("DECIMAL accepts at most precision and scale")
 	}
 	return
 }
@@ -454,14 +803,16 @@ func GetTableSchema(db fdb.Transactor, dbName string, tblName string) (tbl *Tabl
 		return
 	}
 	ret, err1 := db.Transact(func(tr fdb.Transaction) (ret interface{}, err error) {
-		ret = decodeTableSchema(tr.Get(dirSchema).MustGet())
+		ret = tr.Get(dirSchema).MustGet()
 		return
 	})
 	if err1 != nil {
 		err = err1
 		return
 	}
-	tbl = ret.(*TableSchema)
+	tbl = decodeTableSchema(ret.([]byte))
+	tbl.stored = ret.([]byte)
+	tbl.key = dirSchema.Bytes()
 	tbl.Dir = dirTable
 	tbl.DbName = dbName
 	tbl.TblName = tblName
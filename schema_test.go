@@ -1,12 +1,15 @@
 package opentick
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -37,6 +40,75 @@ func Test_EncodeTableSchema(t *testing.T) {
 	t2 := decodeTableSchema(bytes)
 	assert.Equal(t, t2.Cols[2], tbl.Cols[2])
 	assert.Equal(t, *t2.Keys[1], *tbl.Keys[1])
+	assert.Equal(t, map[string]string(nil), t2.Options)
+	tbl2 := NewTableSchema(cols, []int{2, 1})
+	tbl2.Options = map[string]string{"storage": "block"}
+	t2 = decodeTableSchema(tbl2.encode())
+	assert.Equal(t, tbl2.Options, t2.Options)
+	assert.Equal(t, true, t2.blocks())
+}
+
+func Test_DecodeTableSchemaV1(t *testing.T) {
+	// version 1 has number of columns in place of version, and no value position or default
+	var bn [4]byte
+	var bytes []byte
+	put := func(v uint32) {
+		binary.BigEndian.PutUint32(bn[:], v)
+		bytes = append(bytes, bn[:]...)
+	}
+	put(2)
+	put(2)
+	for _, name := range []string{"a", "b"} {
+		put(uint32(len(name)))
+		bytes = append(bytes, name...)
+		put(uint32(Int))
+	}
+	put(1)
+	put(1)
+	t2 := decodeTableSchema(bytes)
+	assert.Equal(t, "b", t2.Keys[0].Name)
+	assert.Equal(t, "a", t2.Values[0].Name)
+	assert.Equal(t, 1, t2.ValueLen)
+}
+
+func Test_EncodeTableSchemaPos(t *testing.T) {
+	cols := []*TableColDef{NewTableColDef("a", Int), NewTableColDef("b", Double), NewTableColDef("c", Timestamp)}
+	tbl := NewTableSchema(cols, []int{0})
+	tbl.Cols[2].Pos = 3
+	tbl.Cols[2].Default = tuple.Tuple{int64(1), int64(2)}
+	tbl.Cols[2].NotNull = true
+	tbl.ValueLen = 4
+	t2 := decodeTableSchema(tbl.encode())
+	assert.Equal(t, uint32(0), t2.NameMap["b"].Pos)
+	assert.Equal(t, uint32(3), t2.NameMap["c"].Pos)
+	assert.Equal(t, tuple.Tuple{int64(1), int64(2)}, t2.NameMap["c"].Default)
+	assert.Equal(t, true, t2.NameMap["c"].NotNull)
+	assert.Equal(t, false, t2.NameMap["b"].NotNull)
+	assert.Equal(t, 4, t2.ValueLen)
+	assert.Equal(t, tuple.Tuple{1.5, nil, nil, tuple.Tuple{int64(1), int64(2)}}, t2.decodeValue(tuple.Tuple{1.5}))
+	assert.Equal(t, tuple.Tuple{1.5, nil, nil, nil}, t2.decodeValue(tuple.Tuple{1.5, nil, nil, nil}))
+	assert.Equal(t, tuple.Tuple{1.5, nil, nil, nil}, t2.decodeValue(tuple.Tuple{float32(1.5), nil, nil, nil}))
+}
+
+func Test_EncodeTableSchemaDecimal(t *testing.T) {
+	col, err := newTableColDef("px", "decimal", []int64{10, 4})
+	assert.Equal(t, nil, err)
+	tbl := NewTableSchema([]*TableColDef{NewTableColDef("sec", Symbol), col, NewTableColDef("raw", Blob)}, []int{0})
+	t2 := decodeTableSchema(tbl.encode())
+	assert.Equal(t, Symbol, t2.NameMap["sec"].Type)
+	assert.Equal(t, Decimal, t2.NameMap["px"].Type)
+	assert.Equal(t, uint32(10), t2.NameMap["px"].Precision)
+	assert.Equal(t, uint32(4), t2.NameMap["px"].Scale)
+	assert.Equal(t, Blob, t2.NameMap["raw"].Type)
+	col, err = newTableColDef("px", "DECIMAL", nil)
+	assert.Equal(t, uint32(18), col.Precision)
+	assert.Equal(t, uint32(0), col.Scale)
+	_, err = newTableColDef("px", "decimal", []int64{19})
+	assert.Equal(t, "DECIMAL precision must be between 1 and 18", err.Error())
+	_, err = newTableColDef("px", "decimal", []int64{4, 5})
+	assert.Equal(t, "DECIMAL scale must be between 0 and precision", err.Error())
+	_, err = newTableColDef("px", "int", []int64{4})
+	assert.Equal(t, "Type Int does not accept parameters", err.Error())
 }
 
 func Benchmark_DecodeTableSchema(b *testing.B) {
@@ -173,3 +245,118 @@ func Test_CreateTable(t *testing.T) {
 	_, err = Execute(db, "", "drop table test.test", nil)
 	assert.Equal(t, nil, err)
 }
+
+func Test_AlterColumn(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, qty int, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 1.5, 100)", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "alter table trade add column venue text default 'XNAS'", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "alter table trade add column flag boolean", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade(sec, time, px, qty) values(1, 2, 2.5, 200)", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, 3, 3.5, 300, 'ARCX', true)", nil)
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select * from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 [1 0] 1.5 100 XNAS <nil>] [1 [2 0] 2.5 200 XNAS <nil>] [1 [3 0] 3.5 300 ARCX true]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "alter table trade drop column qty", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "alter table trade add qty double default 0", nil)
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select * from trade where sec=1 and time=3", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 [3 0] 3.5 ARCX true 0]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "update trade set qty=1.5 where sec=1 and time=1", nil)
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select time, venue, qty from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[[1 0] XNAS 1.5] [[2 0] XNAS 0] [[3 0] ARCX 0]]", fmt.Sprint(ret))
+	_, err = Execute(db, "test", "alter table trade drop column sec", nil)
+	assert.Equal(t, "Cannot drop PRIMARY KEY column sec", err.Error())
+	_, err = Execute(db, "test", "alter table trade drop column qty2", nil)
+	assert.Equal(t, "Column qty2 does not exist", err.Error())
+	_, err = Execute(db, "test", "alter table trade add column px double", nil)
+	assert.Equal(t, "Column px already exists", err.Error())
+	_, err = Execute(db, "test", "alter table trade add column x int default 'a'", nil)
+	assert.Equal(t, "Invalid string value (a) for \"x\" of Int", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_AlterConcurrently(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px double, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	ast, _ := Parse("insert into trade values(?, ?, ?)")
+	stmt, err := resolveInsert(db, "test", ast.Insert)
+	assert.Equal(t, nil, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := Execute(db, "test", "alter table trade add column c"+strconv.Itoa(i)+" int", nil)
+			assert.Equal(t, nil, err)
+		}(i)
+	}
+	wg.Wait()
+	tbl, err := GetTableSchema(db, "test", "trade")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 8, len(tbl.Cols))
+	// resolved before the alters, as if on another server
+	_, err = BatchInsert(db, &stmt, [][]interface{}{{1, 1, 1.5}})
+	assert.Equal(t, "Table test.trade has been altered, please retry", err.Error())
+	_, err = Execute(db, "test", "insert into trade(sec, time, px) values(1, 1, 1.5)", nil)
+	assert.Equal(t, nil, err)
+	Execute(db, "", "drop table test.trade", nil)
+}
+
+func Test_AlterColumnType(t *testing.T) {
+	fdb.MustAPIVersion(FdbVersion)
+	var db = fdb.MustOpenDefault()
+	DropDatabase(db, "test")
+	CreateDatabase(db, "test")
+	_, err := Execute(db, "test", "create table trade(sec int, time timestamp, px float, qty int, flag boolean, primary key(sec, time))", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 1.5, 3000000000, true)", nil)
+	assert.Equal(t, "Value 3000000000 out of range for \"qty\" of Int", err.Error())
+	_, err = Execute(db, "test", "insert into trade values(1, 1, 1.5, 3000000000, true) saturate", nil)
+	assert.Equal(t, nil, err)
+	ret, err := Execute(db, "test", "select px, qty from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1.5 2147483647]]", fmt.Sprint(ret))
+	ast, _ := Parse("update trade set qty=? where sec=1 and time=1")
+	stmt, err := resolveUpdate(db, "test", ast.Update)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "alter table trade alter column px type double", nil)
+	assert.Equal(t, nil, err)
+	// resolved before the type changed
+	err = executeUpdate(db, &stmt, []interface{}{1})
+	assert.Equal(t, "Table test.trade has been altered, please retry", err.Error())
+	_, err = Execute(db, "test", "alter table trade alter qty type bigint", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "alter table trade alter sec type bigint", nil)
+	assert.Equal(t, nil, err)
+	_, err = Execute(db, "test", "insert into trade values(1, 2, 2.5, 3000000000, true)", nil)
+	assert.Equal(t, nil, err)
+	ret, err = Execute(db, "test", "select px, qty from trade where sec=1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1.5, ret[0][0])
+	assert.Equal(t, "[[1.5 2147483647] [2.5 3000000000]]", fmt.Sprint(ret))
+	tbl, _ := GetTableSchema(db, "test", "trade")
+	assert.Equal(t, BigInt, tbl.NameMap["sec"].Type)
+	_, err = Execute(db, "test", "alter table trade alter qty type int", nil)
+	assert.Equal(t, "Cannot change type of column qty from BigInt to Int", err.Error())
+	_, err = Execute(db, "test", "alter table trade alter flag type int", nil)
+	assert.Equal(t, "Cannot change type of column flag from Boolean to Int", err.Error())
+	Execute(db, "", "drop table test.trade", nil)
+}
@@ -3,6 +3,7 @@ package opentick
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/patrickmn/go-cache"
@@ -12,6 +13,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,6 +25,9 @@ var defaultDBs []fdb.Transactor
 var sNumDatabaseConn = 1
 var sMaxConcurrency = 100
 var sTimeout = 0
+
+// frames of a stream sent ahead of the client's acks
+var streamWindow = 16
 var activeConns int32
 var respCache *cache.Cache
 var sPermissionControl bool
@@ -84,13 +89,14 @@ func StartServer(addr string, fdbClusterFile string, numDatabaseConn, maxConcurr
 }
 
 type connection struct {
-	ch     chan []byte
-	conn   net.Conn
-	store  [][]byte
-	mutex  sync.Mutex
-	cond   *sync.Cond
-	closed bool
-	user   *User
+	ch      chan []byte
+	conn    net.Conn
+	store   [][]byte
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	closed  bool
+	user    *User
+	credits map[int]int // of streams by ticket, -1 if cancelled
 }
 
 func (self *connection) Send(msg []byte) {
@@ -108,7 +114,7 @@ func handleConnection(conn net.Conn) {
 		fromLocal := strings.Contains(conn.RemoteAddr().String(), "127.0.0.1:")
 		user.isAdmin = fromLocal
 	}
-	client := connection{ch: ch, conn: conn, user: user}
+	client := connection{ch: ch, conn: conn, user: user, credits: make(map[int]int)}
 	client.cond = sync.NewCond(&client.mutex)
 	defer client.close()
 	go client.writeToConnection()
@@ -206,6 +212,30 @@ func reply(cacheKey string, ticket int, res interface{}, ch chan []byte, useJson
 	ch <- append(size[:], data...)
 }
 
+// one frame of a stream, nothing sent if failed to marshal, the error goes to the end frame
+func replyFrame(ticket int, frame map[string]interface{}, ch chan []byte, useJson bool) (err error) {
+	defer func() {
+		if recover() != nil {
+			// send on closed channel
+			err = errors.New("Connection closed")
+		}
+	}()
+	frame["0"] = ticket
+	var data []byte
+	if useJson {
+		data, err = json.Marshal(frame)
+	} else {
+		data, err = bson.Marshal(frame)
+	}
+	if err != nil {
+		return errors.New("Internal error: " + err.Error())
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+	ch <- append(size[:], data...)
+	return
+}
+
 func (c *connection) writeToConnection() {
 	defer func() {
 		log.Println("Writing thread ended from", c.conn.RemoteAddr())
@@ -230,10 +260,28 @@ func (c *connection) writeToConnection() {
 }
 
 func (self *connection) process() {
-	var prepared [][2]interface{}
+	var prepared [][3]interface{} // statement, sql and database name
 	var usedDbName string
 	var useJson bool
 	var unfinished int32
+	// resolve the prepared statement again after its table was altered
+	reprepare := func(id int, user *User) (stmt interface{}, err error) {
+		self.mutex.Lock()
+		sql, dbName := prepared[id][1].(string), prepared[id][2].(string)
+		self.mutex.Unlock()
+		ast, err := Parse(sql)
+		if err != nil {
+			return
+		}
+		stmt, err = Resolve(getDB(), dbName, ast, user)
+		if err != nil {
+			return
+		}
+		self.mutex.Lock()
+		prepared[id][0] = stmt
+		self.mutex.Unlock()
+		return
+	}
 	for {
 		var body []byte
 		self.mutex.Lock()
@@ -258,7 +306,7 @@ func (self *connection) process() {
 			defer func() {
 				self.mutex.Lock()
 				unfinished--
-				self.cond.Signal()
+				self.cond.Broadcast()
 				self.mutex.Unlock()
 			}()
 			var data map[string]interface{}
@@ -278,7 +326,7 @@ func (self *connection) process() {
 			var cachedSql string
 			var useCache int
 			var schema *TableSchema
-			var schema_res [2][]interface{}
+			var schema_res [3][]interface{}
 			if useJson {
 				err = json.Unmarshal(body, &data)
 			} else {
@@ -306,6 +354,27 @@ func (self *connection) process() {
 				res = fmt.Sprint("Invalid command, exepcted string, got ", data["1"])
 				goto reply
 			}
+			if cmd == "ack" {
+				// frames consumed of the stream, cancelled if not positive, no reply
+				n, ok2 := getInt(data["2"])
+				if f, ok3 := getFloat(data["2"]); ok3 && f == math.Trunc(f) {
+					// numbers of json
+					n, ok2 = int64(f), true
+				}
+				if !ok2 {
+					res = fmt.Sprint("Invalid ack, expected number of frames, got ", data["2"])
+					goto reply
+				}
+				self.mutex.Lock()
+				if c, ok2 := self.credits[ticket]; n <= 0 {
+					self.credits[ticket] = -1
+				} else if ok2 && c >= 0 {
+					self.credits[ticket] = c + int(n)
+				}
+				self.cond.Broadcast()
+				self.mutex.Unlock()
+				return
+			}
 			if len(data) > 3 && data["3"] != nil {
 				args, ok = data["3"].([]interface{})
 				if !ok {
@@ -349,14 +418,65 @@ func (self *connection) process() {
 						}
 					}
 					res, err = ExecuteStmt(getDB(), stmt, args)
+					if isSchemaAltered(err) {
+						if stmt, err = reprepare(preparedId, user); err == nil {
+							res, err = ExecuteStmt(getDB(), stmt, args)
+						}
+					}
 				}
 				if err != nil {
 					res = err.Error()
 				}
+			} else if cmd == "stream" {
+				// numbered frames of rows, then the end frame with error if any,
+				// at most streamWindow frames are not acked yet
+				self.mutex.Lock()
+				if _, ok2 := self.credits[ticket]; !ok2 {
+					self.credits[ticket] = streamWindow
+				}
+				self.mutex.Unlock()
+				seq := 0
+				send := func(rows [][]interface{}) error {
+					if err := self.waitCredit(ticket, &unfinished); err != nil {
+						return err
+					}
+					if err := replyFrame(ticket, map[string]interface{}{"1": rows, "3": seq}, self.ch, useJson); err != nil {
+						return err
+					}
+					seq++
+					return nil
+				}
+				if stmt == nil {
+					err = ExecuteStream(getDB(), dbName, sql, args, send, user)
+				} else {
+					err = ExecuteStmtStream(getDB(), stmt, args, send)
+					if isSchemaAltered(err) && seq == 0 {
+						if stmt, err = reprepare(preparedId, user); err == nil {
+							err = ExecuteStmtStream(getDB(), stmt, args, send)
+						}
+					}
+				}
+				end := map[string]interface{}{"3": seq, "4": true}
+				if err != nil {
+					end["1"] = err.Error()
+				}
+				replyFrame(ticket, end, self.ch, useJson)
+				self.mutex.Lock()
+				delete(self.credits, ticket)
+				self.mutex.Unlock()
+				return
 			} else if cmd == "batch" {
 				if sql != "" {
-					res = "Batch command must be prepared first"
-					goto reply
+					ast, err = Parse(sql)
+					if err != nil {
+						res = err.Error()
+						goto reply
+					}
+					stmt, err = Resolve(getDB(), dbName, ast, user)
+					if err != nil {
+						res = err.Error()
+						goto reply
+					}
 				}
 				stmt2, ok2 := stmt.(insertStmt)
 				if !ok2 {
@@ -377,7 +497,18 @@ func (self *connection) process() {
 					}
 					argsArray[i] = a2
 				}
-				err = BatchInsert(getDB(), &stmt2, argsArray)
+				res, err = BatchInsert(getDB(), &stmt2, argsArray)
+				if isSchemaAltered(err) {
+					if sql != "" {
+						stmt, err = Resolve(getDB(), dbName, ast, user)
+					} else {
+						stmt, err = reprepare(preparedId, user)
+					}
+					if err == nil {
+						stmt2 = stmt.(insertStmt)
+						res, err = BatchInsert(getDB(), &stmt2, argsArray)
+					}
+				}
 				if err != nil {
 					res = err.Error()
 				}
@@ -393,7 +524,7 @@ func (self *connection) process() {
 					goto reply
 				}
 				self.mutex.Lock()
-				prepared = append(prepared, [2]interface{}{res, sql})
+				prepared = append(prepared, [3]interface{}{res, sql, dbName})
 				res = len(prepared) - 1
 				self.mutex.Unlock()
 			} else if cmd == "login" || cmd == "use" {
@@ -474,6 +605,23 @@ func (self *connection) process() {
 					for _, f := range schema.Values {
 						schema_res[1] = append(schema_res[1], []string{f.Name, f.Type.Name()})
 					}
+					for _, name := range []string{"storage", "compression"} {
+						if v, ok := schema.Options[name]; ok {
+							schema_res[2] = append(schema_res[2], []string{name, v})
+						}
+					}
+					if schema.compressor() != nil {
+						raw, stored, err1 := sampleCompression(getDB(), schema)
+						if err1 != nil {
+							res = err1.Error()
+							goto reply
+						}
+						ratio := 1.
+						if stored > 0 {
+							ratio = float64(raw) / float64(stored)
+						}
+						schema_res[2] = append(schema_res[2], []string{"compression_ratio", strconv.FormatFloat(ratio, 'f', 2, 64)})
+					}
 					res = schema_res
 				case "chgpasswd":
 					if len(toks) < 2 {
@@ -511,7 +659,7 @@ func (self *connection) close() {
 	self.conn.Close()
 	self.mutex.Lock()
 	self.closed = true
-	self.cond.Signal()
+	self.cond.Broadcast()
 	self.mutex.Unlock()
 	atomic.AddInt32(&activeConns, -1)
 	log.Println("Closed connection from", self.conn.RemoteAddr(), ", active:", activeConns)
@@ -520,6 +668,27 @@ func (self *connection) close() {
 func (self *connection) push(data []byte) {
 	self.mutex.Lock()
 	self.store = append(self.store, data)
-	self.cond.Signal()
+	self.cond.Broadcast()
 	self.mutex.Unlock()
 }
+
+// wait until the stream of ticket is acked, not counted in unfinished while waiting,
+// so that acks are still processed if all the others are waiting
+func (self *connection) waitCredit(ticket int, unfinished *int32) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for self.credits[ticket] == 0 && !self.closed {
+		*unfinished--
+		self.cond.Broadcast()
+		self.cond.Wait()
+		*unfinished++
+	}
+	if self.closed {
+		return errors.New("Connection closed")
+	}
+	if self.credits[ticket] < 0 {
+		return errors.New("Stream cancelled")
+	}
+	self.credits[ticket]--
+	return nil
+}
@@ -1,6 +1,7 @@
 package opentick
 
 import (
+	"fmt"
 	"github.com/opentradesolutions/opentick/client"
 	"github.com/phayes/freeport"
 	"github.com/stretchr/testify/assert"
@@ -81,10 +82,10 @@ func Test_Server(t *testing.T) {
 	assert.Equal(t, "All array must the same size", err.Error())
 	argsArray = [][]interface{}{[]interface{}{tm, 5}, []interface{}{2., 3}}
 	err = conn.BatchInsert("insert into test(sec, interval, tm, open) values(?, ?, ?, ?)", argsArray)
-	assert.Equal(t, "Expected 4 arguments, got 2", err.Error())
+	assert.Equal(t, "Row 0: Expected 4 arguments, got 2", err.Error())
 	argsArray = [][]interface{}{[]interface{}{tm, 5}, []interface{}{2., 3}}
 	err = conn.BatchInsert("insert into test(sec, interval, tm, open) values(1, 2, ?, ?)", argsArray)
-	assert.Equal(t, "Invalid float64 value (2) for \"tm\" of Timestamp", err.Error())
+	assert.Equal(t, "Row 1: Invalid float64 value (2) for \"tm\" of Timestamp", err.Error())
 	res, err = conn.Execute("select open from test where sec=? and interval=? and tm=?", 1, 2, tm)
 	assert.Equal(t, 0, len(res))
 	_, err = conn.Execute("alter table test rename column tm to time")
@@ -100,6 +101,72 @@ func Test_Server(t *testing.T) {
 	res, err = conn.Execute("select open from test where sec=? and interval=? and time=?", 1, 2, tm)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, float64(3), res[0][0])
+	argsArray = [][]interface{}{[]interface{}{tm, 4}, []interface{}{tm.Add(2 * time.Second), 5}}
+	fut, err := conn.BatchInsertAsync("insert into test(sec, interval, time, open) values(1, 2, ?, ?) on conflict do nothing", argsArray)
+	assert.Equal(t, nil, err)
+	res, err = fut.Get()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[true] [false]]", fmt.Sprint(res))
+	res, err = conn.Execute("select open from test where sec=? and interval=?", 1, 2)
+	assert.Equal(t, "[[3] [4] [5]]", fmt.Sprint(res))
+	_, err = conn.Execute("insert into test(sec, interval, time, open) values(1, 3, ?, 6), (1, 3, ?, 7)", tm, tm.Add(time.Second))
+	assert.Equal(t, nil, err)
+	res, err = conn.Execute("select open from test where sec=? and interval=?", 1, 3)
+	assert.Equal(t, "[[6] [7]]", fmt.Sprint(res))
+	rows, err := conn.Query("select time, open from test where sec=? and interval=?", 1, 3)
+	assert.Equal(t, nil, err)
+	var opens []interface{}
+	for rows.Next() {
+		opens = append(opens, rows.Row()[1])
+	}
+	assert.Equal(t, nil, rows.Err())
+	assert.Equal(t, "[6 7]", fmt.Sprint(opens))
+	rows, err = conn.Query("select time, open from test where sec=1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, rows.Next())
+	assert.Equal(t, tm.UTC(), rows.Row()[0])
+	rows.Close()
+	assert.Equal(t, false, rows.Next())
+	// one frame per row, and one frame ahead of acks
+	window, pageSize := streamWindow, scanPageSize
+	streamWindow, scanPageSize = 1, 1
+	rows, err = conn.Query("select open from test where sec=1")
+	assert.Equal(t, nil, err)
+	opens = nil
+	for rows.Next() {
+		opens = append(opens, rows.Row()[0])
+	}
+	assert.Equal(t, nil, rows.Err())
+	assert.Equal(t, "[3 4 5 6 7]", fmt.Sprint(opens))
+	// cancelled on the server
+	rows, err = conn.Query("select open from test where sec=1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, rows.Next())
+	rows.Close()
+	res, err = conn.Execute("select open from test where sec=? and interval=?", 1, 3)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[6] [7]]", fmt.Sprint(res))
+	streamWindow, scanPageSize = window, pageSize
+	rows, err = conn.Query("select * from test2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, rows.Next())
+	assert.Equal(t, "Table test.test2 does not exists", rows.Err().Error())
+	// prepared statements are resolved again after the table is altered
+	_, err = conn.Execute("insert into test(sec, interval, time, open) values(?, ?, ?, ?)", 2, 1, tm, 1)
+	assert.Equal(t, nil, err)
+	res, err = conn.Execute("select * from test where sec=?", 2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 9, len(res[0]))
+	_, err = conn.Execute("alter table test add column qty int default 0")
+	assert.Equal(t, nil, err)
+	_, err = conn.Execute("insert into test(sec, interval, time, open) values(?, ?, ?, ?)", 2, 1, tm.Add(time.Second), 2)
+	assert.Equal(t, nil, err)
+	res, err = conn.Execute("select * from test where sec=?", 2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 10, len(res[0]))
+	res, err = conn.Execute("select open, qty from test where sec=?", 2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[[1 0] [2 0]]", fmt.Sprint(res))
 	conn.Execute("drop table test")
 }
 
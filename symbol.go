@@ -0,0 +1,191 @@
+package opentick
+
+import (
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"strconv"
+	"sync"
+)
+
+// SYMBOL is stored as int64 id of a dictionary shared by all tables of one database
+
+// validated but not yet translated to id
+type symbol string
+
+type symbolDict struct {
+	Dir   directory.DirectorySubspace
+	ids   sync.Map // name -> id, only committed ones
+	names sync.Map // id -> name, only committed ones
+}
+
+var symbolDicts = sync.Map{}
+
+func getSymbolDict(db fdb.Transactor, dbName string) (dict *symbolDict, err error) {
+	if v, ok := symbolDicts.Load(dbName); ok {
+		return v.(*symbolDict), nil
+	}
+	dir, err1 := directory.CreateOrOpen(db, []string{"symbol", dbName}, nil)
+	if err1 != nil {
+		err = err1
+		return
+	}
+	v, _ := symbolDicts.LoadOrStore(dbName, &symbolDict{Dir: dir})
+	dict = v.(*symbolDict)
+	return
+}
+
+// nil if no symbol column in schema
+func getSchemaSymbolDict(db fdb.Transactor, schema *TableSchema) (dict *symbolDict, err error) {
+	for _, col := range schema.Cols {
+		if col.Type == Symbol {
+			return getSymbolDict(db, schema.DbName)
+		}
+	}
+	return
+}
+
+func dropSymbolDict(db fdb.Transactor, dbName string) (err error) {
+	symbolDicts.Delete(dbName)
+	_, err = directory.Root().Remove(db, []string{"symbol", dbName})
+	return
+}
+
+func (self *symbolDict) get(tr fdb.ReadTransaction, key tuple.Tuple) (ret tuple.Tuple, err error) {
+	bytes, err1 := tr.Get(self.Dir.Pack(key)).Get()
+	if err1 != nil || bytes == nil {
+		err = err1
+		return
+	}
+	ret, err = tuple.Unpack(bytes)
+	return
+}
+
+// -1 if name is not in dictionary
+func (self *symbolDict) lookup(tr fdb.ReadTransaction, name string) (id int64, err error) {
+	if v, ok := self.ids.Load(name); ok {
+		return v.(int64), nil
+	}
+	v, err1 := self.get(tr, tuple.Tuple{"s", name})
+	if err1 != nil {
+		err = err1
+		return
+	}
+	if v == nil {
+		return -1, nil
+	}
+	id = v[0].(int64)
+	self.ids.Store(name, id)
+	self.names.Store(id, name)
+	return
+}
+
+// allocate a new id if name is not in dictionary
+func (self *symbolDict) assign(tr fdb.Transaction, name string) (id int64, err error) {
+	if v, ok := self.ids.Load(name); ok {
+		return v.(int64), nil
+	}
+	v, err1 := self.get(tr, tuple.Tuple{"s", name})
+	if err1 != nil {
+		err = err1
+		return
+	}
+	if v != nil {
+		return v[0].(int64), nil
+	}
+	v, err = self.get(tr, tuple.Tuple{"n"})
+	if err != nil {
+		return
+	}
+	id = 1
+	if v != nil {
+		id = v[0].(int64)
+	}
+	tr.Set(self.Dir.Pack(tuple.Tuple{"s", name}), tuple.Tuple{id}.Pack())
+	tr.Set(self.Dir.Pack(tuple.Tuple{"i", id}), tuple.Tuple{name}.Pack())
+	tr.Set(self.Dir.Pack(tuple.Tuple{"n"}), tuple.Tuple{id + 1}.Pack())
+	return
+}
+
+func (self *symbolDict) name(tr fdb.ReadTransaction, id int64) (name string, err error) {
+	if v, ok := self.names.Load(id); ok {
+		return v.(string), nil
+	}
+	v, err1 := self.get(tr, tuple.Tuple{"i", id})
+	if err1 != nil {
+		err = err1
+		return
+	}
+	if v == nil {
+		err = errors.New("Internal errror: unknown symbol id " + strconv.FormatInt(id, 10))
+		return
+	}
+	name = v[0].(string)
+	self.ids.Store(name, id)
+	self.names.Store(id, name)
+	return
+}
+
+func (self *symbolDict) assignAll(tr fdb.Transaction, values []tuple.TupleElement) (err error) {
+	for i, v := range values {
+		if s, ok := v.(symbol); ok {
+			values[i], err = self.assign(tr, string(s))
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (self *symbolDict) lookupValue(tr fdb.ReadTransaction, v interface{}) (ret interface{}, err error) {
+	switch v1 := v.(type) {
+	case symbol:
+		return self.lookup(tr, string(v1))
+	case []interface{}:
+		values := make([]interface{}, len(v1))
+		for i, v2 := range v1 {
+			values[i], err = self.lookupValue(tr, v2)
+			if err != nil {
+				return
+			}
+		}
+		return values, nil
+	}
+	return v, nil
+}
+
+// translate symbol values of where ranges to ids
+func (self *symbolDict) lookupRanges(db fdb.Transactor, ranges []whereRange) (err error) {
+	_, err = db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, err error) {
+		for j := range ranges {
+			r := &ranges[j]
+			if r.Conds != nil {
+				conds := make([]condition, len(r.Conds))
+				copy(conds, r.Conds)
+				for i := range conds {
+					c := &conds[i]
+					for _, v := range []*interface{}{&c.Equal, &c.Start[0], &c.End[0]} {
+						if *v, err = self.lookupValue(tr, *v); err != nil {
+							return
+						}
+					}
+				}
+				r.Conds = conds
+			}
+			if r.Filters != nil {
+				filters := make([]filter, len(r.Filters))
+				copy(filters, r.Filters)
+				for i := range filters {
+					if filters[i].Value, err = self.lookupValue(tr, filters[i].Value); err != nil {
+						return
+					}
+				}
+				r.Filters = filters
+			}
+		}
+		return
+	})
+	return
+}
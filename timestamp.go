@@ -0,0 +1,114 @@
+package opentick
+
+import (
+	"errors"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"time"
+)
+
+// NOW() plus offset in nanoseconds, evaluated on every execution of a prepared statement
+type relativeTime int64
+
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// str without offset is regarded as wall clock of loc
+func parseTimestampLiteral(str string, loc *time.Location) (tm time.Time, err error) {
+	for _, layout := range timestampLayouts {
+		tm, err = time.ParseInLocation(layout, str, loc)
+		if err == nil {
+			return
+		}
+	}
+	err = errors.New("Invalid timestamp '" + str + "'")
+	return
+}
+
+func nsToTimestamp(ns int64) tuple.Tuple {
+	sec := floorDiv(ns, 1e9)
+	return tuple.Tuple{sec, ns - sec*1e9}
+}
+
+func evalRelativeTime(v interface{}, now int64) interface{} {
+	switch v1 := v.(type) {
+	case relativeTime:
+		return nsToTimestamp(now + int64(v1))
+	case []interface{}:
+		values := make([]interface{}, len(v1))
+		for i, v2 := range v1 {
+			values[i] = evalRelativeTime(v2, now)
+		}
+		return values
+	}
+	return v
+}
+
+func hasRelativeTime(r *whereRange) bool {
+	has := func(v interface{}) bool {
+		switch v1 := v.(type) {
+		case relativeTime:
+			return true
+		case []interface{}:
+			for _, v2 := range v1 {
+				if _, ok := v2.(relativeTime); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for i := range r.Conds {
+		c := &r.Conds[i]
+		if has(c.Equal) || has(c.Start[0]) || has(c.End[0]) {
+			return true
+		}
+	}
+	for i := range r.Filters {
+		if has(r.Filters[i].Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// replace NOW() of where ranges with the same now
+func evalRangesTime(ranges []whereRange, now int64) {
+	for j := range ranges {
+		r := &ranges[j]
+		if !hasRelativeTime(r) {
+			continue
+		}
+		conds := make([]condition, len(r.Conds))
+		copy(conds, r.Conds)
+		for i := range conds {
+			c := &conds[i]
+			c.Equal = evalRelativeTime(c.Equal, now)
+			c.Start[0] = evalRelativeTime(c.Start[0], now)
+			c.End[0] = evalRelativeTime(c.End[0], now)
+		}
+		if r.Conds != nil {
+			r.Conds = conds
+		}
+		if r.Filters != nil {
+			filters := make([]filter, len(r.Filters))
+			copy(filters, r.Filters)
+			for i := range filters {
+				filters[i].Value = evalRelativeTime(filters[i].Value, now)
+			}
+			r.Filters = filters
+		}
+	}
+}
+
+func formatTimestamp(v interface{}, loc *time.Location) interface{} {
+	ns, ok := getTimestamp(v)
+	if !ok {
+		return v
+	}
+	return time.Unix(0, ns).In(loc).Format(time.RFC3339Nano)
+}